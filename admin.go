@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errPaused means the heartbeats were queued for a paused backend.
+	errPaused = errors.New("backend paused")
+	// errDisabled means a disabled backend was sent nothing.
+	errDisabled = errors.New("backend disabled")
+)
+
+// AdminConfig enables the admin API on a separate listener.
+type AdminConfig struct {
+	// Listen is a loopback address such as "127.0.0.1:3001". The admin API
+	// is off when it is empty.
+	Listen string `toml:"listen"`
+	// Token must be sent as a bearer token with every admin request.
+	Token string `toml:"token"`
+}
+
+func (c AdminConfig) enabled() bool {
+	return c.Listen != ""
+}
+
+// check validates the listen address and token.
+func (c AdminConfig) check() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Token == "" {
+		return errors.New("admin token is required")
+	}
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return fmt.Errorf("admin listen: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin listen must be a loopback address, got %q", c.Listen)
+	}
+	return nil
+}
+
+type backendStatus struct {
+	Name     string `json:"name"`
+	Primary  bool   `json:"is_primary"`
+	Paused   bool   `json:"paused"`
+	Disabled bool   `json:"disabled"`
+	Breaker  string `json:"breaker"`
+	Failures int    `json:"consecutive_failures"`
+	Queued   int    `json:"queued"`
+	Dead     int    `json:"dead_letters"`
+	// Forwarded and Failed count heartbeats since startup. A heartbeat that
+	// is retried from the outbox counts again.
+	Forwarded int `json:"forwarded"`
+	Failed    int `json:"failed"`
+	// Probe is the outcome of the last API key check, and ProbedAt when it
+	// ran.
+	Probe        string         `json:"probe"`
+	ProbedAt     *time.Time     `json:"probed_at,omitempty"`
+	LastError    string         `json:"last_error,omitempty"`
+	LastErrorAt  *time.Time     `json:"last_error_at,omitempty"`
+	RecentErrors []backendError `json:"recent_errors,omitempty"`
+}
+
+// adminHandler routes the admin API. Every request needs the configured
+// bearer token, except for the dashboard page, which asks for it.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/backends", handleAdminBackends)
+	mux.HandleFunc("GET /admin/heartbeats", handleAdminHeartbeats)
+	mux.HandleFunc("POST /admin/backends/{name}/pause", handleAdminHold(true, false))
+	mux.HandleFunc("POST /admin/backends/{name}/disable", handleAdminHold(false, true))
+	mux.HandleFunc("POST /admin/backends/{name}/resume", handleAdminHold(false, false))
+	mux.HandleFunc("POST /admin/backends/{name}/flush", handleAdminFlush)
+	mux.HandleFunc("GET /admin/backends/{name}/dead-letters", handleAdminDeadLetters)
+	mux.HandleFunc("POST /admin/backends/{name}/dead-letters/requeue", handleAdminSettleDeadLetters)
+	mux.HandleFunc("POST /admin/backends/{name}/dead-letters/{id}/requeue", handleAdminSettleDeadLetters)
+	mux.HandleFunc("DELETE /admin/backends/{name}/dead-letters", handleAdminSettleDeadLetters)
+	mux.HandleFunc("DELETE /admin/backends/{name}/dead-letters/{id}", handleAdminSettleDeadLetters)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dashboard" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			handleDashboard(w, r)
+			return
+		}
+
+		token := currentConfig().Admin.Token
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="multitime admin"`)
+			writeJSON(w, http.StatusUnauthorized, errorBody("Unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin runs the admin API until the listener fails or srv is shut
+// down.
+func serveAdmin(srv *http.Server) {
+	slog.Info("Starting admin API", "listen", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		slog.Error("Admin API stopped", "error", err)
+	}
+}
+
+// handleAdminBackends reports the state of every configured backend.
+func handleAdminBackends(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	statuses := make([]backendStatus, 0, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		s := stateFor(b)
+		state, failures := s.breaker.State()
+		status := backendStatus{
+			Name:     b.Name,
+			Primary:  b.IsPrimary,
+			Paused:   s.isPaused(),
+			Disabled: s.isDisabled(),
+			Breaker:  state.String(),
+			Failures: failures,
+			Dead:     len(s.deadLetters()),
+
+			Forwarded:    int(heartbeatsForwarded.sum(b.Name)),
+			Failed:       int(heartbeatsFailed.sum(b.Name)),
+			RecentErrors: s.recentErrors(),
+		}
+		if s.outbox != nil {
+			status.Queued = s.outbox.Len()
+		}
+		switch p := s.lastProbe(); {
+		case p.checkedAt.IsZero():
+			status.Probe = "pending"
+		case p.err != nil:
+			status.Probe = secrets.redact(p.err.Error())
+			status.ProbedAt = &p.checkedAt
+		default:
+			status.Probe = "ok"
+			status.ProbedAt = &p.checkedAt
+		}
+		if len(status.RecentErrors) > 0 {
+			last := status.RecentErrors[0]
+			status.LastError, status.LastErrorAt = last.Message, &last.At
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		slog.Debug("Could not write backend status", "error", err)
+	}
+}
+
+// adminBackend looks up the backend named in the request path, answering 404
+// if there is none.
+func adminBackend(w http.ResponseWriter, r *http.Request) (*backendState, bool) {
+	name := r.PathValue("name")
+	for _, b := range currentConfig().Backends {
+		if b.Name == name {
+			return stateFor(b), true
+		}
+	}
+	writeJSON(w, http.StatusNotFound, errorBody(fmt.Sprintf("No backend named %q", name)))
+	return nil, false
+}
+
+// handleAdminHold pauses, disables or resumes a backend. A paused backend
+// keeps queueing heartbeats without sending them; a disabled one is sent
+// nothing at all. Neither survives a restart.
+func handleAdminHold(paused, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := adminBackend(w, r)
+		if !ok {
+			return
+		}
+		s.setHeld(paused, disabled)
+		slog.Info("Backend changed by admin API", "backend", s.current().Name, "paused", paused, "disabled", disabled)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminFlush makes the backend's drainer send its outbox now.
+func handleAdminFlush(w http.ResponseWriter, r *http.Request) {
+	s, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	if s.held() {
+		writeJSON(w, http.StatusConflict, errorBody("Backend is paused or disabled"))
+		return
+	}
+	s.requestFlush()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAdminDeadLetters lists the heartbeats the backend rejected.
+func handleAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	s, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+	entries := s.deadLetters()
+	if entries == nil {
+		entries = []Entry{}
+	}
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
+
+// handleAdminSettleDeadLetters requeues (POST) or drops (DELETE) one dead
+// letter, or all of them when no id is given.
+func handleAdminSettleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	s, ok := adminBackend(w, r)
+	if !ok {
+		return
+	}
+
+	var ids []uint64
+	if value := r.PathValue("id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorBody("Invalid dead letter id"))
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	settle := s.requeueDeadLetters
+	if r.Method == http.MethodDelete {
+		settle = s.dropDeadLetters
+	}
+	n, err := settle(ids...)
+	switch {
+	case errors.Is(err, errDeadLetterMissing):
+		writeJSON(w, http.StatusNotFound, errorBody(err.Error()))
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, errorBody(err.Error()))
+		return
+	}
+	payload, _ := json.Marshal(map[string]int{"count": n})
+	writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdminConfigCheck(t *testing.T) {
+	tests := []struct {
+		cfg   AdminConfig
+		valid bool
+	}{
+		{AdminConfig{}, true},
+		{AdminConfig{Listen: "127.0.0.1:3001", Token: "secret"}, true},
+		{AdminConfig{Listen: "localhost:3001", Token: "secret"}, true},
+		{AdminConfig{Listen: "[::1]:3001", Token: "secret"}, true},
+		{AdminConfig{Listen: "127.0.0.1:3001"}, false},
+		{AdminConfig{Listen: "0.0.0.0:3001", Token: "secret"}, false},
+		{AdminConfig{Listen: ":3001", Token: "secret"}, false},
+		{AdminConfig{Listen: "127.0.0.1", Token: "secret"}, false},
+	}
+	for _, tc := range tests {
+		if err := tc.cfg.check(); (err == nil) != tc.valid {
+			t.Errorf("check(%+v) returned %v, expected valid=%v", tc.cfg, err, tc.valid)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	cfg := setupTestConfig(t)
+	cfg.Admin = AdminConfig{Listen: "127.0.0.1:3001", Token: "admin-token"}
+
+	var status atomic.Int32
+	status.Store(http.StatusCreated)
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+	cfg.Backends[0].URL = server.URL
+	cfg.Backends[1].URL = server.URL
+	cfg.Backends[1].Retry = RetryPolicy{MaxAttempts: 1}
+
+	admin := httptest.NewServer(adminHandler())
+	defer admin.Close()
+	call := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, admin.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	heartbeat := func(entity string) {
+		req, _ := http.NewRequest("POST", "/users/current/heartbeats", strings.NewReader(`{"entity":"`+entity+`","type":"file","time":1700000000}`))
+		rr := httptest.NewRecorder()
+		handleHeartbeat(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 for %s, got %d", entity, rr.Code)
+		}
+		detached.Wait()
+	}
+	backend := "/admin/backends/Secondary%20Backend"
+	s := stateFor(cfg.Backends[1])
+
+	for _, token := range []string{"", "wrong"} {
+		if resp := call("GET", "/admin/backends", token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+	if resp := call("POST", "/admin/backends/Missing/pause", "admin-token"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown backend, got %d", resp.StatusCode)
+	}
+
+	// A paused backend queues heartbeats without sending them.
+	if resp := call("POST", backend+"/pause", "admin-token"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 from pause, got %d", resp.StatusCode)
+	}
+	heartbeat("paused.go")
+	if received.Load() != 1 || s.outbox.Len() != 1 {
+		t.Errorf("Expected only the primary to be sent the heartbeat, got %d requests and %d queued", received.Load(), s.outbox.Len())
+	}
+	if resp := call("POST", backend+"/flush", "admin-token"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a paused backend not to flush, got %d", resp.StatusCode)
+	}
+
+	// Resuming sends the queued heartbeat straight away.
+	call("POST", backend+"/resume", "admin-token")
+	waitFor(t, func() bool { return s.outbox.Len() == 0 })
+	if received.Load() != 2 {
+		t.Errorf("Expected the queued heartbeat to be sent on resume, got %d requests", received.Load())
+	}
+
+	// A disabled backend is sent nothing.
+	call("POST", backend+"/disable", "admin-token")
+	heartbeat("disabled.go")
+	if received.Load() != 3 || s.outbox.Len() != 0 {
+		t.Errorf("Expected the disabled backend to be skipped, got %d requests and %d queued", received.Load(), s.outbox.Len())
+	}
+	call("POST", backend+"/resume", "admin-token")
+
+	// Rejected heartbeats are kept as dead letters.
+	status.Store(http.StatusBadRequest)
+	resp, _ := s.forward(Entry{Body: []byte(`{"entity":"rejected.go","type":"file","time":1700000000}`)})
+	resp.Body.Close()
+
+	var statuses []backendStatus
+	json.NewDecoder(call("GET", "/admin/backends", "admin-token").Body).Decode(&statuses)
+	if len(statuses) != 2 || statuses[1].Dead != 1 || statuses[1].LastError != "rejected with 400 Bad Request" {
+		t.Errorf("Unexpected backend status: %+v", statuses)
+	}
+
+	var dead []Entry
+	json.NewDecoder(call("GET", backend+"/dead-letters", "admin-token").Body).Decode(&dead)
+	if len(dead) != 1 || dead[0].Reason != "rejected with 400 Bad Request" {
+		t.Fatalf("Expected one dead letter, got %+v", dead)
+	}
+
+	status.Store(http.StatusCreated)
+	before := received.Load()
+	if resp := call("POST", backend+"/dead-letters/"+strconv.FormatUint(dead[0].ID, 10)+"/requeue", "admin-token"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 from requeue, got %d", resp.StatusCode)
+	}
+	call("POST", backend+"/flush", "admin-token")
+	waitFor(t, func() bool { return received.Load() > before && s.outbox.Len() == 0 })
+	if n := len(s.deadLetters()); n != 0 {
+		t.Errorf("Expected the dead letter to be requeued, %d left", n)
+	}
+
+	s.deadLetter(Entry{Body: []byte(`{"entity":"drop.go"}`)}, "rejected with 400 Bad Request")
+	if resp := call("DELETE", backend+"/dead-letters/999", "admin-token"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown dead letter, got %d", resp.StatusCode)
+	}
+	if resp := call("DELETE", backend+"/dead-letters", "admin-token"); resp.StatusCode != http.StatusOK || len(s.deadLetters()) != 0 {
+		t.Errorf("Expected every dead letter to be dropped, got %d with %d left", resp.StatusCode, len(s.deadLetters()))
+	}
+}
+
+// waitFor polls until cond holds, failing the test after a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
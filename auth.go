@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authentication schemes: how a backend's API key is sent.
+const (
+	// authBasic sends "Authorization: Basic base64(api_key)", as WakaTime
+	// expects.
+	authBasic = "basic"
+	// authBearer sends "Authorization: Bearer api_key".
+	authBearer = "bearer"
+	// authQuery adds the key as an api_key query parameter.
+	authQuery = "query"
+	// authNone sends no key, e.g. when a header in headers authenticates.
+	authNone = "none"
+)
+
+// checkAuth validates a backend's auth_scheme and headers.
+func checkAuth(b Backend) error {
+	switch b.AuthScheme {
+	case "", authBasic, authBearer, authQuery, authNone:
+	default:
+		return fmt.Errorf("auth_scheme must be %q, %q, %q or %q, got %q", authBasic, authBearer, authQuery, authNone, b.AuthScheme)
+	}
+	for name, value := range b.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %q contains a line break", name)
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether name is an HTTP header field name token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// credentialHeader reports whether a header is likely to carry a credential,
+// so its value should be kept out of logs.
+func credentialHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"authorization", "cookie", "token", "secret", "key"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize adds the backend's API key to a request according to its
+// auth_scheme, followed by its custom headers, which take precedence over
+// any header multitime sets itself.
+func authorize(req *http.Request, b Backend) {
+	switch b.AuthScheme {
+	case authBearer:
+		req.Header.Set("Authorization", "Bearer "+b.APIKey)
+	case authQuery:
+		query := req.URL.Query()
+		query.Set("api_key", b.APIKey)
+		req.URL.RawQuery = query.Encode()
+	case authNone:
+	default:
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(b.APIKey)))
+	}
+
+	for name, value := range b.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
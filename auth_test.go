@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		scheme string
+		auth   string
+		query  string
+	}{
+		{"", "Basic a2V5", ""},
+		{authBasic, "Basic a2V5", ""},
+		{authBearer, "Bearer key", ""},
+		{authQuery, "", "api_key=key"},
+		{authNone, "", ""},
+	}
+	for _, tc := range tests {
+		req, _ := http.NewRequest("GET", "https://example.com/api/v1/users/current", nil)
+		authorize(req, Backend{APIKey: "key", AuthScheme: tc.scheme})
+		if got := req.Header.Get("Authorization"); got != tc.auth {
+			t.Errorf("%q: expected Authorization %q, got %q", tc.scheme, tc.auth, got)
+		}
+		if req.URL.RawQuery != tc.query {
+			t.Errorf("%q: expected query %q, got %q", tc.scheme, tc.query, req.URL.RawQuery)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.com/api", nil)
+	req.Header.Set("User-Agent", "wakatime")
+	authorize(req, Backend{APIKey: "key", Headers: map[string]string{
+		"CF-Access-Client-Id": "client-id",
+		"User-Agent":          "custom",
+		"Host":                "wakapi.internal",
+	}})
+	if req.Header.Get("Cf-Access-Client-Id") != "client-id" || req.Header.Get("User-Agent") != "custom" || req.Host != "wakapi.internal" {
+		t.Errorf("Expected the custom headers to be set, got %v with host %q", req.Header, req.Host)
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	tests := []struct {
+		backend Backend
+		valid   bool
+	}{
+		{Backend{}, true},
+		{Backend{AuthScheme: authBearer, Headers: map[string]string{"X-Auth": "secret"}}, true},
+		{Backend{AuthScheme: "digest"}, false},
+		{Backend{Headers: map[string]string{"Bad Header": "x"}}, false},
+		{Backend{Headers: map[string]string{"X-Auth:": "x"}}, false},
+		{Backend{Headers: map[string]string{"X-Auth": "x\r\nX-Injected: y"}}, false},
+	}
+	for _, tc := range tests {
+		if err := checkAuth(tc.backend); (err == nil) != tc.valid {
+			t.Errorf("checkAuth(%q, %v) returned %v, expected valid=%v", tc.backend.AuthScheme, tc.backend.Headers, err, tc.valid)
+		}
+	}
+}
+
+func TestCredentialHeader(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Authorization":           true,
+		"Proxy-Authorization":     true,
+		"Cookie":                  true,
+		"CF-Access-Client-Secret": true,
+		"X-Api-Key":               true,
+		"X-Auth-Token":            true,
+		"CF-Access-Client-Id":     false,
+		"X-Forwarded-Proto":       false,
+		"Host":                    false,
+	} {
+		if got := credentialHeader(name); got != want {
+			t.Errorf("credentialHeader(%q) = %v, expected %v", name, got, want)
+		}
+	}
+}
+
+func TestAuthAppliedToEveryRequest(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]*http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path] = r
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`
+[[backends]]
+name = "Behind Access"
+url = "`+server.URL+`/api"
+api_key = "wakapi-key"
+auth_scheme = "bearer"
+is_primary = true
+
+[backends.headers]
+CF-Access-Client-Id = "client-id"
+CF-Access-Client-Secret = "client-secret"
+X-Forwarded-Proto = "https"
+`), 0o600)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	b := cfg.Backends[0]
+	t.Cleanup(func() { closeClient(b.Name) })
+
+	if got := secrets.redact("secret is client-secret"); strings.Contains(got, "client-secret") {
+		t.Errorf("Expected header values to be redacted, got %q", got)
+	}
+	if got := secrets.redact("scheme is https"); got != "scheme is https" {
+		t.Errorf("Expected headers without credentials to be left alone, got %q", got)
+	}
+
+	ctx := context.Background()
+	for _, send := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return forwardHeartbeat(ctx, []byte(`{}`), "test", "", b) },
+		func() (*http.Response, error) { return forwardHeartbeats(ctx, []byte(`[]`), "test", "", b) },
+		func() (*http.Response, error) { return fetchStatusBar(ctx, "test", b) },
+		func() (*http.Response, error) { return fetchCurrentUser(ctx, b) },
+	} {
+		resp, err := send()
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if len(seen) != 4 {
+		t.Fatalf("Expected four endpoints to be called, got %d", len(seen))
+	}
+	for path, r := range seen {
+		if r.Header.Get("Authorization") != "Bearer wakapi-key" || r.Header.Get("CF-Access-Client-Secret") != "client-secret" {
+			t.Errorf("%s: expected the bearer token and custom headers, got %v", path, r.Header)
+		}
+	}
+}
+
+func TestQueryKeyKeptOutOfErrors(t *testing.T) {
+	cfg := setupTestConfig(t)
+	cfg.Admin = AdminConfig{Listen: "127.0.0.1:3001", Token: "admin-token"}
+	cfg.Backends = cfg.Backends[:1]
+	cfg.Backends[0].URL = "http://127.0.0.1:1/api"
+	cfg.Backends[0].APIKey = "SUPERSECRETKEY"
+	cfg.Backends[0].AuthScheme = authQuery
+	t.Cleanup(func() { closeClient(cfg.Backends[0].Name) })
+
+	probeBackends(cfg)
+	if _, err := stateFor(cfg.Backends[0]).forward(Entry{Body: []byte(`{}`)}); err == nil {
+		t.Fatal("Expected the unreachable backend to fail")
+	}
+
+	for path, handler := range map[string]http.Handler{
+		"/readyz":         http.HandlerFunc(handleReadyz),
+		"/admin/backends": adminHandler(),
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if body := rr.Body.String(); strings.Contains(body, "SUPERSECRETKEY") || !strings.Contains(body, "127.0.0.1:1") {
+			t.Errorf("%s: expected the error without the API key, got %s", path, body)
+		}
+	}
+}
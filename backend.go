@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drainInterval is how often each backend's outbox is retried.
+const drainInterval = 10 * time.Second
+
+// backendState holds the runtime state for a configured backend: its rules,
+// outbox, dedup window, circuit breaker and the drainer that replays the
+// outbox.
+type backendState struct {
+	mu      sync.Mutex
+	backend Backend
+	// notBefore holds off the drainer, e.g. after a Retry-After header.
+	notBefore time.Time
+	probe     probeResult
+	// paused holds heartbeats in the outbox and disabled stops sending the
+	// backend anything; both are set through the admin API.
+	paused   bool
+	disabled bool
+	// lastErrors holds the most recent delivery failures, oldest first.
+	lastErrors []backendError
+
+	rules   *backendRules
+	outbox  *Outbox
+	dead    *Outbox
+	dedup   *dedupWindow
+	breaker *circuitBreaker
+	wake    chan struct{}
+	flushes chan struct{}
+	// ctx is cancelled when the backend stops, aborting its requests and
+	// retries.
+	ctx  context.Context
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+var (
+	statesMu sync.Mutex
+	states   = map[string]*backendState{}
+)
+
+// stateFor returns the runtime state for a backend, opening its outbox and
+// starting its drainer on first use.
+func stateFor(b Backend) *backendState {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	cfg := currentConfig()
+
+	if s, ok := states[b.Name]; ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if b.generation < s.backend.generation {
+			return s
+		}
+		// Compiling the rules is costly and this runs for every request, so
+		// it is only done when a reload brought a new config.
+		if b.generation != s.backend.generation {
+			s.rules = rulesFor(b)
+		}
+		s.backend = b
+		s.breaker.configure(b.Breaker)
+		return s
+	}
+
+	s := &backendState{
+		backend: b,
+		rules:   rulesFor(b),
+		breaker: newCircuitBreaker(b.Name, b.Breaker),
+		wake:    make(chan struct{}, 1),
+		flushes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+
+	// A request still using an older snapshot may refer to a backend that has
+	// since been removed. It gets a stopped state that sends nothing, rather
+	// than bringing the backend's outbox and drainer back.
+	if cfg != nil && !slices.ContainsFunc(cfg.Backends, func(c Backend) bool { return c.Name == b.Name }) {
+		s.stop()
+		close(s.done)
+		return s
+	}
+
+	if cfg != nil && cfg.QueueDir != "" {
+		dir := filepath.Join(cfg.QueueDir, queueName(b.Name))
+		outbox, err := openOutbox(dir)
+		if err != nil {
+			slog.Warn("Could not open outbox, forwarding without it", "backend", b.Name, "error", err)
+		} else {
+			s.outbox = outbox
+		}
+		dead, err := openOutbox(filepath.Join(dir, "dead-letters"))
+		if err != nil {
+			slog.Warn("Could not open dead letters, rejected heartbeats will be dropped", "backend", b.Name, "error", err)
+		} else {
+			s.dead = dead
+		}
+		if !cfg.Dedup.Disabled {
+			dedup, err := openDedupWindow(dir, cfg.Dedup)
+			if err != nil {
+				slog.Warn("Could not open dedup window, duplicates will not be detected", "backend", b.Name, "error", err)
+			} else {
+				s.dedup = dedup
+			}
+		}
+	}
+	states[b.Name] = s
+	go s.drain()
+	return s
+}
+
+// stopBackends stops every drainer and closes the outboxes.
+func stopBackends() {
+	statesMu.Lock()
+	stopping := states
+	states = map[string]*backendState{}
+	statesMu.Unlock()
+
+	closeStates(stopping)
+}
+
+// syncBackends brings the backend states in line with a new config: existing
+// backends pick up their new settings, new ones start draining and removed
+// ones stop. A removed backend's outbox stays on disk and resumes draining if
+// the backend is added back.
+func syncBackends(cfg *Config) {
+	names := make(map[string]bool, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		names[b.Name] = true
+		stateFor(b)
+	}
+
+	stopping := map[string]*backendState{}
+	statesMu.Lock()
+	for name, s := range states {
+		if !names[name] {
+			stopping[name] = s
+			delete(states, name)
+		}
+	}
+	statesMu.Unlock()
+
+	closeStates(stopping)
+}
+
+// closeStates closes backend states that have been taken out of states. It
+// runs without holding statesMu, so requests for other backends are not held
+// up while a drainer finishes the request it is in.
+func closeStates(stopping map[string]*backendState) {
+	var wg sync.WaitGroup
+	for _, s := range stopping {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.close()
+		}()
+	}
+	wg.Wait()
+}
+
+// close stops the drainer, closes the outbox, dead letters and dedup window
+// and drops the backend's idle connections.
+func (s *backendState) close() {
+	s.stop()
+	<-s.done
+	closeClient(s.current().Name)
+	if s.outbox != nil {
+		s.outbox.Close()
+	}
+	if s.dead != nil {
+		s.dead.Close()
+	}
+	if s.dedup != nil {
+		s.dedup.Close()
+	}
+}
+
+var unsafeQueueChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// queueName turns a backend name into a directory name. Names that do not
+// survive that unchanged get a short hash of the original appended, so
+// "Foo Bar" and "foo-bar", or two non-Latin names, never share an outbox.
+func queueName(name string) string {
+	safe := strings.Trim(unsafeQueueChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if safe == name {
+		return safe
+	}
+	sum := sha256.Sum256([]byte(name))
+	if safe == "" {
+		return "backend-" + hex.EncodeToString(sum[:4])
+	}
+	return safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// rulesFor compiles a backend's rules. Invalid rules are rejected when the
+// config is loaded; a backend that bypassed that is sent nothing rather than
+// something it should not see.
+func rulesFor(b Backend) *backendRules {
+	rules, err := compileRules(b)
+	if err != nil {
+		slog.Error("Invalid rules, sending the backend nothing", "backend", b.Name, "error", err)
+		return &backendRules{invalid: true}
+	}
+	return rules
+}
+
+// prepare returns the heartbeat as the backend should receive it, or false if
+// its rules say it should not receive it.
+func (s *backendState) prepare(h Heartbeat) (Heartbeat, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rules.apply(h)
+}
+
+func (s *backendState) current() Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend
+}
+
+// forward persists the entry in the outbox and then makes one attempt to send
+// it to the backend. It runs while the editor waits, so a failed attempt is
+// left for the drainer to retry according to the backend's policy, or retried
+// in the background if the entry could not be queued. The caller owns the
+// returned response body.
+func (s *backendState) forward(e Entry) (*http.Response, error) {
+	b := s.current()
+	if s.outbox != nil {
+		if queued, err := s.outbox.Append(e); err != nil {
+			slog.Warn("Could not queue heartbeat", "backend", b.Name, "error", err)
+		} else {
+			e = queued
+		}
+	}
+
+	if !s.breaker.Allow() {
+		slog.Debug("Circuit breaker is open, heartbeat left in outbox", "backend", b.Name, "entry", e.ID)
+		if s.outbox != nil && e.ID != 0 {
+			s.outbox.Release(e.ID)
+		}
+		return nil, errCircuitOpen
+	}
+
+	resp, wait, err := sendOnce(s.ctx, b, e)
+	switch {
+	case s.settle(e, resp, err):
+	case s.outbox == nil || e.ID == 0:
+		s.retry(e, wait)
+	default:
+		s.deferUntil(time.Now().Add(wait))
+		s.notify()
+	}
+	return resp, err
+}
+
+// retry sends an entry that is not in the outbox again, in the background,
+// with the attempts left by forward's first one, and settles the outcome.
+func (s *backendState) retry(e Entry, wait time.Duration) {
+	b := s.current()
+	attempts := b.Retry.withDefaults().MaxAttempts
+	if attempts <= 1 {
+		return
+	}
+	b.Retry.MaxAttempts = attempts - 1
+
+	detached.Add(1)
+	go func() {
+		defer detached.Done()
+		select {
+		case <-time.After(wait):
+		case <-givingUp():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+		resp, _, err := sendWithRetry(s.ctx, b, e)
+		s.settle(e, resp, err)
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+}
+
+// enqueue persists the entry in the outbox and leaves delivery to the drainer.
+func (s *backendState) enqueue(e Entry) error {
+	if s.outbox == nil {
+		return errors.New("outbox unavailable")
+	}
+	queued, err := s.outbox.Append(e)
+	if err != nil {
+		return err
+	}
+	s.outbox.Release(queued.ID)
+	s.notify()
+	return nil
+}
+
+// notify wakes the drainer without waiting for its next scheduled pass.
+func (s *backendState) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// settle acknowledges or releases a queued entry based on the backend's answer
+// and reports whether the backend is done with it.
+func (s *backendState) settle(e Entry, resp *http.Response, err error) bool {
+	b := s.current()
+	policy := b.Retry.withDefaults()
+
+	var retry bool
+	switch {
+	case err != nil:
+		slog.Warn("Backend unreachable, heartbeat kept in outbox", "backend", b.Name, "entry", e.ID, "error", err)
+		s.setLastError(err.Error())
+		retry = true
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		var failed map[int]bool
+		if e.Bulk {
+			failed = s.requeueFailedItems(e, resp)
+		}
+		s.markDelivered(e, failed)
+	case policy.retryable(resp.StatusCode):
+		slog.Warn("Backend failed, heartbeat kept in outbox", "backend", b.Name, "entry", e.ID, "status", resp.StatusCode)
+		s.setLastError("returned " + resp.Status)
+		retry = true
+	default:
+		slog.Warn("Backend rejected heartbeat, moving it to dead letters", "backend", b.Name, "entry", e.ID, "status", resp.StatusCode)
+		s.deadLetter(e, rejectedReason(resp.StatusCode))
+	}
+
+	if retry {
+		s.breaker.Failure()
+	} else {
+		s.breaker.Success()
+	}
+
+	if s.outbox == nil || e.ID == 0 {
+		return !retry
+	}
+	if retry {
+		s.outbox.Release(e.ID)
+		return false
+	}
+	if err := s.outbox.Ack(e.ID); err != nil {
+		slog.Error("Could not acknowledge heartbeat", "backend", b.Name, "entry", e.ID, "error", err)
+	}
+	return true
+}
+
+// requeueFailedItems inspects the per-heartbeat results of a bulk response and
+// queues the heartbeats the backend could not take right now as a new entry.
+// Heartbeats it rejected go to the dead letters. It returns the positions of
+// the heartbeats that were not delivered.
+func (s *backendState) requeueFailedItems(e Entry, resp *http.Response) map[int]bool {
+	b := s.current()
+	policy := b.Retry.withDefaults()
+
+	heartbeats, err := splitBulk(e.Body)
+	if err != nil {
+		return nil
+	}
+	items, ok := bulkItems(resp, len(heartbeats))
+	if !ok {
+		return nil
+	}
+
+	var failed []json.RawMessage
+	positions := map[int]bool{}
+	for i, item := range items {
+		switch {
+		case item.ok():
+		case policy.retryable(item.Status):
+			failed = append(failed, heartbeats[i])
+			positions[i] = true
+		default:
+			slog.Warn("Backend rejected heartbeat in bulk, moving it to dead letters", "backend", b.Name, "entry", e.ID, "index", i, "status", item.Status)
+			s.deadLetter(Entry{UserAgent: e.UserAgent, MachineName: e.MachineName, Body: heartbeats[i]}, rejectedReason(item.Status))
+			positions[i] = true
+		}
+	}
+	if len(failed) == 0 || s.outbox == nil {
+		return positions
+	}
+
+	body, err := json.Marshal(failed)
+	if err != nil {
+		return positions
+	}
+	slog.Warn("Backend failed part of a bulk, queueing it for retry", "backend", b.Name, "entry", e.ID, "failed", len(failed), "heartbeats", len(items))
+	retry, err := s.outbox.Append(Entry{Bulk: true, UserAgent: e.UserAgent, MachineName: e.MachineName, Body: body})
+	if err != nil {
+		slog.Error("Could not queue failed heartbeats", "backend", b.Name, "error", err)
+		return positions
+	}
+	s.outbox.Release(retry.ID)
+	return positions
+}
+
+// admit reports, for each heartbeat, whether it has not been forwarded to
+// this backend before, and remembers the new ones.
+func (s *backendState) admit(heartbeats []Heartbeat) []bool {
+	keys := make([]string, len(heartbeats))
+	for i, h := range heartbeats {
+		keys[i] = heartbeatKey(h)
+	}
+	if s.dedup == nil {
+		fresh := make([]bool, len(keys))
+		for i := range fresh {
+			fresh[i] = true
+		}
+		return fresh
+	}
+
+	fresh, err := s.dedup.admit(keys)
+	if err != nil {
+		slog.Warn("Could not record heartbeats", "backend", s.current().Name, "error", err)
+	}
+	return fresh
+}
+
+// markDelivered remembers that the backend accepted the heartbeats of an
+// entry, except those at the skipped positions.
+func (s *backendState) markDelivered(e Entry, skipped map[int]bool) {
+	if s.dedup == nil {
+		return
+	}
+	heartbeats, err := entryHeartbeats(e)
+	if err != nil {
+		return
+	}
+	var keys []string
+	for i, h := range heartbeats {
+		if !skipped[i] {
+			keys = append(keys, heartbeatKey(h))
+		}
+	}
+	if err := s.dedup.markDelivered(keys); err != nil {
+		slog.Warn("Could not record delivered heartbeats", "backend", s.current().Name, "error", err)
+	}
+}
+
+// withoutDelivered drops heartbeats the backend already accepted from a
+// queued entry, e.g. when it is replayed after a crash that happened between
+// delivery and acknowledgement. It reports whether anything is left to send.
+func (s *backendState) withoutDelivered(e Entry) (Entry, bool) {
+	if s.dedup == nil {
+		return e, true
+	}
+	heartbeats, err := entryHeartbeats(e)
+	if err != nil {
+		return e, true
+	}
+
+	var remaining []Heartbeat
+	for _, h := range heartbeats {
+		if !s.dedup.delivered(heartbeatKey(h)) {
+			remaining = append(remaining, h)
+		}
+	}
+	if len(remaining) == len(heartbeats) {
+		return e, true
+	}
+	slog.Debug("Skipping already delivered heartbeats", "backend", s.current().Name, "entry", e.ID, "heartbeats", len(heartbeats)-len(remaining))
+	if len(remaining) == 0 {
+		return e, false
+	}
+	body, err := encodeHeartbeats(remaining, e.Bulk)
+	if err != nil {
+		return e, true
+	}
+	e.Body = body
+	return e, true
+}
+
+// pendingEntries acknowledges the claimed entries the backend already accepted
+// and returns the rest, trimmed to the heartbeats still to be sent.
+func (s *backendState) pendingEntries(batch []Entry) []Entry {
+	pending := batch[:0]
+	for _, e := range batch {
+		if e, ok := s.withoutDelivered(e); ok {
+			pending = append(pending, e)
+		} else {
+			s.outbox.Ack(e.ID)
+		}
+	}
+	return pending
+}
+
+// deferUntil holds off the drainer until the given time, e.g. because the
+// backend sent a Retry-After header.
+func (s *backendState) deferUntil(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.After(s.notBefore) {
+		s.notBefore = t
+	}
+}
+
+// held reports whether the backend is paused or disabled.
+func (s *backendState) held() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused || s.disabled
+}
+
+func (s *backendState) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+func (s *backendState) isDisabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disabled
+}
+
+// setHeld pauses or disables the backend, or lifts it. Lifting it flushes the
+// outbox straight away.
+func (s *backendState) setHeld(paused, disabled bool) {
+	s.mu.Lock()
+	s.paused, s.disabled = paused, disabled
+	s.mu.Unlock()
+	if !paused && !disabled {
+		s.requestFlush()
+	}
+}
+
+// requestFlush makes the drainer flush the outbox now, ignoring any backoff.
+func (s *backendState) requestFlush() {
+	s.mu.Lock()
+	s.notBefore = time.Time{}
+	s.mu.Unlock()
+	select {
+	case s.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// backendError is a delivery failure reported by the admin API.
+type backendError struct {
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// recentErrorLimit is how many delivery failures are kept per backend.
+const recentErrorLimit = 10
+
+// setLastError remembers a delivery failure for the admin API, keeping the
+// most recent few. Secrets are redacted as they are in logs.
+func (s *backendState) setLastError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErrors = append(s.lastErrors, backendError{Message: secrets.redact(msg), At: time.Now()})
+	if len(s.lastErrors) > recentErrorLimit {
+		s.lastErrors = slices.Delete(s.lastErrors, 0, len(s.lastErrors)-recentErrorLimit)
+	}
+}
+
+// recentErrors returns the remembered delivery failures, newest first.
+func (s *backendState) recentErrors() []backendError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := slices.Clone(s.lastErrors)
+	slices.Reverse(errs)
+	return errs
+}
+
+// deferred returns how long the drainer still has to hold off.
+func (s *backendState) deferred() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Until(s.notBefore)
+}
+
+// drain replays the outbox until the backend accepts every entry, backing off
+// between failed passes.
+func (s *backendState) drain() {
+	defer close(s.done)
+	if s.outbox == nil {
+		<-s.ctx.Done()
+		return
+	}
+
+	timer := time.NewTimer(drainInterval)
+	defer timer.Stop()
+	failures := 0
+	collecting := false
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.flushes:
+		case <-s.wake:
+			// Give single heartbeats a moment to pile up into a batch.
+			batch := s.current().Batch
+			if batch.enabled() && s.outbox.Len() < batch.Size {
+				if !collecting {
+					collecting = true
+					timer.Reset(batch.window())
+				}
+				continue
+			}
+		}
+		collecting = false
+
+		next := drainInterval
+		switch wait := s.deferred(); {
+		case s.held():
+			// Nothing is sent while paused or disabled.
+		case wait > 0:
+			next = wait
+		case s.flush():
+			failures = 0
+		default:
+			failures++
+			next = max(s.current().Retry.withDefaults().backoff(failures), s.deferred())
+			s.deferUntil(time.Now().Add(next))
+		}
+		timer.Reset(next)
+	}
+}
+
+// flush sends queued entries oldest first, stopping at the first failure. It
+// reports whether the outbox was fully drained.
+func (s *backendState) flush() bool {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return false
+		default:
+		}
+
+		size := 1
+		if b := s.current(); b.Batch.enabled() {
+			size = b.Batch.Size
+			if b.MaxBulkSize > 0 {
+				size = min(size, b.MaxBulkSize)
+			}
+		}
+		batch := s.outbox.ClaimBatch(size)
+		if len(batch) == 0 {
+			return true
+		}
+		// Entries already delivered are dropped before asking the breaker,
+		// which lets a single probe through when half-open and needs to hear
+		// how it went.
+		if batch = s.pendingEntries(batch); len(batch) == 0 {
+			continue
+		}
+		if !s.breaker.Allow() {
+			for _, e := range batch {
+				s.outbox.Release(e.ID)
+			}
+			s.deferUntil(time.Now().Add(s.breaker.retryIn()))
+			return false
+		}
+
+		if len(batch) > 1 {
+			if !s.deliverBatch(batch) {
+				return false
+			}
+			continue
+		}
+
+		e := batch[0]
+		resp, wait, err := sendWithRetry(s.ctx, s.current(), e)
+		delivered := s.settle(e, resp, err)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if !delivered {
+			s.deferUntil(time.Now().Add(wait))
+			return false
+		}
+	}
+}
+
+// send forwards an entry to the matching WakaTime endpoint.
+func send(ctx context.Context, b Backend, e Entry) (*http.Response, error) {
+	defer func(start time.Time) {
+		upstreamDuration.observe(time.Since(start).Seconds(), b.Name, endpointName(e.Bulk))
+	}(time.Now())
+
+	if e.Bulk {
+		return forwardHeartbeats(ctx, e.Body, e.UserAgent, e.MachineName, b)
+	}
+	return forwardHeartbeat(ctx, e.Body, e.UserAgent, e.MachineName, b)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// errBatched is reported for a backend that queued a heartbeat to send later
+// as part of a bulk request instead of forwarding it right away.
+var errBatched = errors.New("queued for batching")
+
+// BatchConfig controls coalescing of single heartbeats into bulk requests.
+type BatchConfig struct {
+	Size   int      `toml:"size"`
+	Window Duration `toml:"window"`
+}
+
+// enabled reports whether single heartbeats should be batched at all.
+func (c BatchConfig) enabled() bool {
+	return c.Size > 1
+}
+
+// window returns how long to wait for more heartbeats before sending a batch.
+func (c BatchConfig) window() time.Duration {
+	if c.Window.Duration <= 0 {
+		return 5 * time.Second
+	}
+	return c.Window.Duration
+}
+
+// deliverBatch sends several queued single heartbeats as one bulk request and
+// settles each of them according to its per-heartbeat result. It reports
+// whether the backend handled the request.
+func (s *backendState) deliverBatch(batch []Entry) bool {
+	b := s.current()
+	policy := b.Retry.withDefaults()
+
+	heartbeats := make([]json.RawMessage, len(batch))
+	for i, e := range batch {
+		heartbeats[i] = e.Body
+	}
+	body, err := json.Marshal(heartbeats)
+	if err != nil {
+		slog.Error("Could not build batch", "backend", b.Name, "error", err)
+		s.breaker.cancelProbe()
+		for _, e := range batch {
+			s.outbox.Release(e.ID)
+		}
+		return false
+	}
+
+	resp, wait, err := sendWithRetry(s.ctx, b, Entry{Bulk: true, UserAgent: batch[0].UserAgent, MachineName: batch[0].MachineName, Body: body})
+	if err != nil || policy.retryable(resp.StatusCode) {
+		if err != nil {
+			slog.Warn("Backend unreachable, batch kept in outbox", "backend", b.Name, "heartbeats", len(batch), "error", err)
+			s.setLastError(err.Error())
+		} else {
+			slog.Warn("Backend failed, batch kept in outbox", "backend", b.Name, "heartbeats", len(batch), "status", resp.StatusCode)
+			s.setLastError("returned " + resp.Status)
+			resp.Body.Close()
+		}
+		s.breaker.Failure()
+		for _, e := range batch {
+			s.outbox.Release(e.ID)
+		}
+		s.deferUntil(time.Now().Add(wait))
+		return false
+	}
+	defer resp.Body.Close()
+	s.breaker.Success()
+
+	accepted := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !accepted {
+		slog.Warn("Backend rejected batch, moving it to dead letters", "backend", b.Name, "heartbeats", len(batch), "status", resp.StatusCode)
+	} else {
+		slog.Debug("Sent batch", "backend", b.Name, "heartbeats", len(batch), "status", resp.StatusCode)
+	}
+	items, ok := bulkItems(resp, len(batch))
+	for i, e := range batch {
+		switch {
+		case !accepted:
+			s.deadLetter(e, rejectedReason(resp.StatusCode))
+		case ok && !items[i].ok():
+			if policy.retryable(items[i].Status) {
+				s.outbox.Release(e.ID)
+				continue
+			}
+			slog.Warn("Backend rejected heartbeat, moving it to dead letters", "backend", b.Name, "entry", e.ID, "status", items[i].Status)
+			s.deadLetter(e, rejectedReason(items[i].Status))
+		default:
+			s.markDelivered(e, nil)
+		}
+		if err := s.outbox.Ack(e.ID); err != nil {
+			slog.Error("Could not acknowledge heartbeat", "backend", b.Name, "entry", e.ID, "error", err)
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClaimBatch(t *testing.T) {
+	setupTestConfig(t)
+	o, err := openOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("openOutbox returned error: %v", err)
+	}
+	defer o.Close()
+
+	for _, e := range []Entry{
+		{UserAgent: "vscode", Body: []byte(`{"entity":"a.go","type":"file","time":1700000000}`)},
+		{UserAgent: "vscode", Body: []byte(`{"entity":"b.go","type":"file","time":1700000000}`)},
+		{UserAgent: "vim", Body: []byte(`{"entity":"c.go","type":"file","time":1700000000}`)},
+		{UserAgent: "vim", Bulk: true, Body: []byte(`[{"entity":"d.go","type":"file","time":1700000000}]`)},
+	} {
+		queued, _ := o.Append(e)
+		o.Release(queued.ID)
+	}
+
+	if batch := o.ClaimBatch(5); len(batch) != 2 {
+		t.Errorf("Expected a batch of the 2 vscode heartbeats, got %d", len(batch))
+	}
+	if batch := o.ClaimBatch(5); len(batch) != 1 || batch[0].UserAgent != "vim" || batch[0].Bulk {
+		t.Errorf("Expected a batch of the single vim heartbeat, got %+v", batch)
+	}
+	if batch := o.ClaimBatch(5); len(batch) != 1 || !batch[0].Bulk {
+		t.Errorf("Expected the bulk entry on its own, got %+v", batch)
+	}
+	if batch := o.ClaimBatch(5); len(batch) != 0 {
+		t.Errorf("Expected nothing left to claim, got %+v", batch)
+	}
+}
+
+func TestHandleHeartbeatBatching(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"data":"primary success"}`))
+	}))
+	defer primaryServer.Close()
+
+	var mu sync.Mutex
+	var requests []string
+	secondaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, r.URL.Path+" "+string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"responses":[[{},201],[{},201],[{},201]]}`))
+	}))
+	defer secondaryServer.Close()
+
+	cfg.Backends[0].URL = primaryServer.URL
+	cfg.Backends[1].URL = secondaryServer.URL
+	cfg.Backends[1].Batch = BatchConfig{Size: 3, Window: Duration{time.Hour}}
+
+	for _, entity := range []string{"a.go", "b.go", "c.go"} {
+		req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"`+entity+`","type":"file","time":1700000000}`)))
+		rr := httptest.NewRecorder()
+		handleHeartbeat(rr, req)
+		if rr.Body.String() != `{"data":"primary success"}` {
+			t.Errorf("Expected the primary to answer, got %s", rr.Body.String())
+		}
+	}
+
+	// The third heartbeat fills the batch, so it is sent without waiting for
+	// the window to pass.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(requests)
+		mu.Unlock()
+		if n > 0 && stateFor(cfg.Backends[1]).outbox.Len() == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := `/v1/users/current/heartbeats.bulk [{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000},{"entity":"c.go","type":"file","time":1700000000}]`
+	if len(requests) != 1 || requests[0] != expected {
+		t.Errorf("Expected one bulk request %q, got %q", expected, requests)
+	}
+	if n := stateFor(cfg.Backends[1]).outbox.Len(); n != 0 {
+		t.Errorf("Expected the batch to be acknowledged, %d entries left", n)
+	}
+
+	// When only a batching backend takes the heartbeat, the client still gets
+	// a WakaTime-shaped answer.
+	primaryServer.Close()
+	cfg.Backends[0].Retry = RetryPolicy{MaxAttempts: 1}
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", strings.NewReader(`{"entity":"d.go","type":"file","time":1700000000}`))
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+	if rr.Code != http.StatusCreated || rr.Body.String() != `{"data":{"entity":"d.go","type":"file","time":1700000000}}` {
+		t.Errorf("Expected a local acknowledgement, got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of contacting a backend whose circuit
+// breaker is open. The heartbeat stays in the outbox.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig controls when a failing backend is skipped.
+type BreakerConfig struct {
+	FailureThreshold int      `toml:"failure_threshold"`
+	Cooldown         Duration `toml:"cooldown"`
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 5
+	}
+	if c.Cooldown.Duration <= 0 {
+		c.Cooldown.Duration = 30 * time.Second
+	}
+	return c
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker trips after FailureThreshold consecutive failures. While open
+// every request is refused; once Cooldown has passed a single probe is let
+// through, and its outcome either closes the breaker or reopens it.
+type circuitBreaker struct {
+	name string
+	now  func() time.Time
+
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// lastSuccess is when the backend last handled a request.
+	lastSuccess time.Time
+}
+
+func newCircuitBreaker(name string, cfg BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{name: name, cfg: cfg.withDefaults(), now: time.Now}
+}
+
+// configure applies new thresholds without resetting the current state.
+func (cb *circuitBreaker) configure(cfg BreakerConfig) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.cfg = cfg.withDefaults()
+}
+
+// Allow reports whether a request may be sent to the backend right now.
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cfg.Cooldown.Duration {
+			return false
+		}
+		cb.setState(breakerHalfOpen)
+		cb.probing = true
+		return true
+	case breakerHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a request the backend handled.
+func (cb *circuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	cb.probing = false
+	cb.lastSuccess = cb.now()
+	if cb.state != breakerClosed {
+		cb.setState(breakerClosed)
+	}
+}
+
+// Failure records a request the backend could not handle.
+func (cb *circuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	cb.probing = false
+	if cb.state == breakerHalfOpen || (cb.state == breakerClosed && cb.failures >= cb.cfg.FailureThreshold) {
+		cb.openedAt = cb.now()
+		cb.setState(breakerOpen)
+	}
+}
+
+// cancelProbe gives back a probe that was let through but never sent, so the
+// next attempt can take its place.
+func (cb *circuitBreaker) cancelProbe() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+}
+
+// State returns the current state and number of consecutive failures.
+func (cb *circuitBreaker) State() (breakerState, int) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state, cb.failures
+}
+
+// LastSuccess returns when the backend last handled a request, or the zero
+// time if it has not since multitime started.
+func (cb *circuitBreaker) LastSuccess() time.Time {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.lastSuccess
+}
+
+// retryIn returns how long until an open breaker lets a probe through.
+func (cb *circuitBreaker) retryIn() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != breakerOpen {
+		return 0
+	}
+	return cb.cfg.Cooldown.Duration - cb.now().Sub(cb.openedAt)
+}
+
+func (cb *circuitBreaker) setState(state breakerState) {
+	slog.Info("Circuit breaker changed state", "backend", cb.name, "from", cb.state.String(), "to", state.String(), "failures", cb.failures)
+	cb.state = state
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	originalOutput := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(originalOutput)
+
+	now := time.Now()
+	cb := newCircuitBreaker("Test Backend", BreakerConfig{FailureThreshold: 2, Cooldown: Duration{time.Minute}})
+	cb.now = func() time.Time { return now }
+
+	cb.Failure()
+	if state, _ := cb.State(); state != breakerClosed {
+		t.Fatalf("Expected breaker to stay closed after 1 failure, got %s", state)
+	}
+	cb.Failure()
+	if state, _ := cb.State(); state != breakerOpen {
+		t.Fatalf("Expected breaker to open after 2 failures, got %s", state)
+	}
+	if cb.Allow() {
+		t.Error("Open breaker should refuse requests during the cool-down")
+	}
+
+	now = now.Add(time.Minute)
+	if !cb.Allow() {
+		t.Fatal("Breaker should let a probe through after the cool-down")
+	}
+	if cb.Allow() {
+		t.Error("Half-open breaker should only let one probe through")
+	}
+	cb.Failure()
+	if state, _ := cb.State(); state != breakerOpen {
+		t.Fatalf("Expected failed probe to reopen the breaker, got %s", state)
+	}
+
+	now = now.Add(time.Minute)
+	if !cb.Allow() {
+		t.Fatal("Breaker should let a probe through after the cool-down")
+	}
+	cb.Success()
+	if state, failures := cb.State(); state != breakerClosed || failures != 0 {
+		t.Errorf("Expected successful probe to close the breaker, got %s with %d failures", state, failures)
+	}
+}
+
+func TestOpenBreakerSkipsBackend(t *testing.T) {
+	cfg := setupTestConfig(t)
+	originalOutput := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(originalOutput)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg.Backends[1].URL = server.URL
+	cfg.Backends[1].Retry = RetryPolicy{MaxAttempts: 1}
+	cfg.Backends[1].Breaker = BreakerConfig{FailureThreshold: 1, Cooldown: Duration{time.Hour}}
+	s := stateFor(cfg.Backends[1])
+
+	for i := 0; i < 3; i++ {
+		resp, err := s.forward(Entry{Body: []byte(`{"entity":"main.go"}`)})
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if i > 0 && err != errCircuitOpen {
+			t.Errorf("Expected errCircuitOpen once the breaker tripped, got %v", err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected only 1 request to reach the backend, got %d", calls.Load())
+	}
+	if s.outbox.Len() != 3 {
+		t.Errorf("Expected all 3 heartbeats to be queued, got %d", s.outbox.Len())
+	}
+
+	rr := httptest.NewRecorder()
+	handleAdminBackends(rr, httptest.NewRequest("GET", "/admin/backends", nil))
+	var statuses []backendStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Failed to decode admin response: %v", err)
+	}
+	if len(statuses) != 2 || statuses[1].Breaker != "open" || statuses[1].Queued != 3 {
+		t.Errorf("Unexpected backend status: %+v", statuses)
+	}
+}
+
+func TestHalfOpenBreakerSkipsDeliveredEntries(t *testing.T) {
+	for _, batch := range []BatchConfig{{}, {Size: 2}} {
+		cfg := setupTestConfig(t)
+		var received atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received.Add(1)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+		cfg.Backends[1].URL = server.URL
+		cfg.Backends[1].Batch = batch
+		cfg.Backends[1].Breaker = BreakerConfig{FailureThreshold: 1, Cooldown: Duration{time.Minute}}
+		s := stateFor(cfg.Backends[1])
+
+		// Two heartbeats delivered before a crash, queued ahead of a new one.
+		for _, entity := range []string{"a.go", "b.go", "c.go"} {
+			body := `{"entity":"` + entity + `","type":"file","time":1700000000}`
+			if entity != "c.go" {
+				s.dedup.markDelivered([]string{heartbeatKey(Heartbeat{Entity: entity, Type: "file", Time: 1700000000})})
+			}
+			e, _ := s.outbox.Append(Entry{Body: []byte(body)})
+			s.outbox.Release(e.ID)
+		}
+
+		now := time.Now()
+		s.breaker.now = func() time.Time { return now }
+		s.breaker.Failure()
+		now = now.Add(time.Minute)
+
+		if !s.flush() || received.Load() != 1 || s.outbox.Len() != 0 {
+			t.Errorf("Batch %+v: expected only the new heartbeat to be sent, got %d requests and %d queued", batch, received.Load(), s.outbox.Len())
+		}
+		if state, _ := s.breaker.State(); state != breakerClosed {
+			t.Errorf("Batch %+v: expected the probe to close the breaker, got %s", batch, state)
+		}
+		stopBackends()
+	}
+}
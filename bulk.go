@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// bulkItem is one [body, status] pair of a heartbeats.bulk response.
+type bulkItem struct {
+	Body   json.RawMessage
+	Status int
+}
+
+func (i *bulkItem) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("expected [body, status], got %d elements", len(pair))
+	}
+	i.Body = pair[0]
+	return json.Unmarshal(pair[1], &i.Status)
+}
+
+func (i bulkItem) MarshalJSON() ([]byte, error) {
+	body := i.Body
+	if body == nil {
+		body = json.RawMessage("null")
+	}
+	return json.Marshal([]any{body, i.Status})
+}
+
+func (i bulkItem) ok() bool {
+	return i.Status >= 200 && i.Status < 300
+}
+
+// bulkResponse is the body returned by the heartbeats.bulk endpoint.
+type bulkResponse struct {
+	Responses []bulkItem `json:"responses"`
+}
+
+// splitBulk splits a bulk request body into its heartbeats.
+func splitBulk(body []byte) ([]json.RawMessage, error) {
+	var heartbeats []json.RawMessage
+	if err := json.Unmarshal(body, &heartbeats); err != nil {
+		return nil, err
+	}
+	return heartbeats, nil
+}
+
+// bufferBody reads a response body into memory and replaces it with a reader
+// over the same bytes, so it can be inspected and still relayed.
+func bufferBody(resp *http.Response) ([]byte, error) {
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return data, err
+}
+
+// bulkItems returns the per-heartbeat results of a bulk response, or false if
+// the backend did not answer with one result per heartbeat.
+func bulkItems(resp *http.Response, count int) ([]bulkItem, bool) {
+	if resp == nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, false
+	}
+	data, err := bufferBody(resp)
+	if err != nil {
+		return nil, false
+	}
+	var parsed bulkResponse
+	if err := json.Unmarshal(data, &parsed); err != nil || len(parsed.Responses) != count {
+		return nil, false
+	}
+	return parsed.Responses, true
+}
+
+// mergeBulkResults rewrites the chosen bulk response so that each heartbeat
+// reports the first success any backend that has answered had for it, in
+// priority order, and heartbeats rejected by validation report their errors.
+// Backends may have been sent only some of the heartbeats; one that no backend
+// has answered for, because they all had it already or are still sending it
+// from the outbox, is reported as created. The chosen response is left
+// untouched when it has no per-heartbeat results.
+func mergeBulkResults(heartbeats []Heartbeat, chosen forwardResult, order []Backend, results map[string]forwardResult, rejected map[int]validationErrors) {
+	if _, ok := bulkItems(chosen.resp, len(chosen.indices)); !ok {
+		return
+	}
+
+	merged := make([]bulkItem, len(heartbeats))
+	filled := make([]bool, len(heartbeats))
+	candidates := []forwardResult{chosen}
+	for _, b := range order {
+		if result, found := results[b.Name]; found && b.Name != chosen.backend.Name && result.err == nil {
+			candidates = append(candidates, result)
+		}
+	}
+	for _, result := range candidates {
+		items, ok := bulkItems(result.resp, len(result.indices))
+		if !ok {
+			continue
+		}
+		for j, item := range items {
+			i := result.indices[j]
+			if !filled[i] || (!merged[i].ok() && item.ok()) {
+				merged[i] = item
+				filled[i] = true
+			}
+		}
+	}
+	for i, h := range heartbeats {
+		if !filled[i] {
+			data, _ := json.Marshal(map[string]Heartbeat{"data": h})
+			merged[i] = bulkItem{Body: data, Status: http.StatusCreated}
+		}
+	}
+
+	data, err := json.Marshal(bulkResponse{Responses: insertRejected(merged, rejected)})
+	if err != nil {
+		slog.Error("Could not merge bulk responses", "error", err)
+		return
+	}
+	chosen.resp.Body = io.NopCloser(bytes.NewReader(data))
+	chosen.resp.Header.Del("Content-Length")
+}
+
+// sendChunked sends a bulk entry that is larger than the backend's
+// max_bulk_size as several requests and stitches the per-heartbeat results
+// back together into a single bulk response. Heartbeats in a chunk that failed
+// as a whole are reported with that chunk's status (502 for network errors) so
+// they are retried individually.
+func sendChunked(ctx context.Context, b Backend, e Entry, heartbeats []json.RawMessage) (*http.Response, time.Duration, error) {
+	size := b.MaxBulkSize
+	var (
+		merged   []bulkItem
+		template *http.Response
+		wait     time.Duration
+		lastErr  error
+		accepted bool
+	)
+
+	for start := 0; start < len(heartbeats); start += size {
+		chunk := heartbeats[start:min(start+size, len(heartbeats))]
+		body, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		resp, chunkWait, err := sendWithRetry(ctx, b, Entry{ID: e.ID, Bulk: true, UserAgent: e.UserAgent, MachineName: e.MachineName, Body: body})
+		wait = max(wait, chunkWait)
+		status := http.StatusBadGateway
+		if err != nil {
+			slog.Warn("Bulk chunk failed", "backend", b.Name, "start", start, "end", start+len(chunk), "error", err)
+			lastErr = err
+		} else {
+			status = resp.StatusCode
+			if items, ok := bulkItems(resp, len(chunk)); ok {
+				merged = append(merged, items...)
+				chunk = nil
+			}
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				accepted = true
+				if template == nil {
+					template = resp
+				}
+			}
+			if template != resp {
+				resp.Body.Close()
+			}
+		}
+		for range chunk {
+			merged = append(merged, bulkItem{Body: json.RawMessage("null"), Status: status})
+		}
+	}
+
+	if !accepted {
+		if lastErr != nil {
+			return nil, wait, lastErr
+		}
+		// Every chunk was refused; report it the way a single request would.
+		return &http.Response{
+			Status:     strconv.Itoa(merged[0].Status) + " " + http.StatusText(merged[0].Status),
+			StatusCode: merged[0].Status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+		}, wait, nil
+	}
+
+	data, err := json.Marshal(bulkResponse{Responses: merged})
+	if err != nil {
+		template.Body.Close()
+		return nil, wait, err
+	}
+	template.Body.Close()
+	template.Body = io.NopCloser(bytes.NewReader(data))
+	template.Header.Del("Content-Length")
+	return template, wait, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestBulkItemRoundTrip(t *testing.T) {
+	data := `{"responses":[[{"data":{"id":"1"}},201],[{"error":"bad"},400]]}`
+
+	var parsed bulkResponse
+	if err := json.Unmarshal([]byte(data), &parsed); err != nil {
+		t.Fatalf("Failed to parse bulk response: %v", err)
+	}
+	if len(parsed.Responses) != 2 || !parsed.Responses[0].ok() || parsed.Responses[1].Status != 400 {
+		t.Fatalf("Unexpected bulk items: %+v", parsed.Responses)
+	}
+
+	out, err := json.Marshal(parsed)
+	if err != nil {
+		t.Fatalf("Failed to encode bulk response: %v", err)
+	}
+	if string(out) != data {
+		t.Errorf("Expected %s, got %s", data, out)
+	}
+
+	if err := json.Unmarshal([]byte(`{"responses":[[{}]]}`), &parsed); err == nil {
+		t.Error("Expected an error for a result without a status")
+	}
+}
+
+func TestHandleHeartbeatsBulkPartialFailure(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	// The primary rejects the second heartbeat with a retryable error, the
+	// secondary accepts both.
+	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"responses":[[{"data":{"id":"p1"}},201],[{"error":"try again"},500]]}`))
+	}))
+	defer primaryServer.Close()
+
+	secondaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"responses":[[{"data":{"id":"s1"}},201],[{"data":{"id":"s2"}},201]]}`))
+	}))
+	defer secondaryServer.Close()
+
+	for i := range cfg.Backends {
+		if cfg.Backends[i].IsPrimary {
+			cfg.Backends[i].URL = primaryServer.URL
+		} else {
+			cfg.Backends[i].URL = secondaryServer.URL
+		}
+	}
+
+	body := []byte(`[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]`)
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	handleHeartbeatsBulk(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	expected := `{"responses":[[{"data":{"id":"p1"}},201],[{"data":{"id":"s2"}},201]]}`
+	if rr.Body.String() != expected {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// Only the failed heartbeat is queued for the primary.
+	primary := stateFor(cfg.Backends[0])
+	if primary.outbox.Len() != 1 {
+		t.Fatalf("Expected 1 queued entry for the primary, got %d", primary.outbox.Len())
+	}
+	e := primary.outbox.ClaimBatch(1)[0]
+	if !e.Bulk || string(e.Body) != `[{"entity":"b.go","type":"file","time":1700000000}]` {
+		t.Errorf("Unexpected queued entry: %+v", e)
+	}
+	if n := stateFor(cfg.Backends[1]).outbox.Len(); n != 0 {
+		t.Errorf("Expected nothing queued for the secondary, got %d", n)
+	}
+}
+
+func TestForwardSplitsOversizedBulk(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var mu sync.Mutex
+	var chunks []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var heartbeats []json.RawMessage
+		json.NewDecoder(r.Body).Decode(&heartbeats)
+		mu.Lock()
+		chunks = append(chunks, len(heartbeats))
+		n := len(chunks)
+		mu.Unlock()
+
+		if n == 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		responses := make([]bulkItem, len(heartbeats))
+		for i := range responses {
+			responses[i] = bulkItem{Body: json.RawMessage(`{}`), Status: http.StatusCreated}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(bulkResponse{Responses: responses})
+	}))
+	defer server.Close()
+
+	s := stateFor(addTestBackend(cfg, Backend{Name: "Capped Backend", URL: server.URL, MaxBulkSize: 2, Retry: RetryPolicy{MaxAttempts: 1}}))
+	resp, err := s.forward(Entry{Bulk: true, Body: []byte(`[{"entity":"a"},{"entity":"b"},{"entity":"c"},{"entity":"d"},{"entity":"e"}]`)})
+	if err != nil {
+		t.Fatalf("forward returned error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if fmt.Sprint(chunks) != "[2 2 1]" {
+		t.Errorf("Expected chunks of [2 2 1], got %v", chunks)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	var merged bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&merged); err != nil {
+		t.Fatalf("Failed to decode merged response: %v", err)
+	}
+	var statuses []int
+	for _, item := range merged.Responses {
+		statuses = append(statuses, item.Status)
+	}
+	if fmt.Sprint(statuses) != "[201 201 503 503 201]" {
+		t.Errorf("Unexpected per-heartbeat statuses: %v", statuses)
+	}
+
+	batch := s.outbox.ClaimBatch(1)
+	if len(batch) != 1 || string(batch[0].Body) != `[{"entity":"c"},{"entity":"d"}]` {
+		t.Errorf("Expected only the failed chunk to be queued, got %+v", batch)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPConfig tunes the connections made to a backend. Zero values use the
+// defaults in withDefaults.
+type HTTPConfig struct {
+	// Timeout bounds a whole request, including reading the response.
+	Timeout               Duration `toml:"timeout"`
+	DialTimeout           Duration `toml:"dial_timeout"`
+	TLSHandshakeTimeout   Duration `toml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration `toml:"response_header_timeout"`
+	// IdleConnTimeout is how long an unused keep-alive connection is kept.
+	IdleConnTimeout     Duration `toml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int      `toml:"max_idle_conns_per_host"`
+	// MaxConnsPerHost caps the connections to the backend; 0 means no
+	// limit.
+	MaxConnsPerHost int `toml:"max_conns_per_host"`
+}
+
+func (c HTTPConfig) withDefaults() HTTPConfig {
+	if c.Timeout.Duration <= 0 {
+		c.Timeout.Duration = 10 * time.Second
+	}
+	if c.DialTimeout.Duration <= 0 {
+		c.DialTimeout.Duration = 5 * time.Second
+	}
+	if c.TLSHandshakeTimeout.Duration <= 0 {
+		c.TLSHandshakeTimeout.Duration = 5 * time.Second
+	}
+	if c.ResponseHeaderTimeout.Duration <= 0 {
+		c.ResponseHeaderTimeout.Duration = c.Timeout.Duration
+	}
+	if c.IdleConnTimeout.Duration <= 0 {
+		c.IdleConnTimeout.Duration = 90 * time.Second
+	}
+	if c.MaxIdleConnsPerHost <= 0 {
+		c.MaxIdleConnsPerHost = 16
+	}
+	return c
+}
+
+// check rejects negative timeouts and limits.
+func (c HTTPConfig) check() error {
+	for _, d := range []Duration{c.Timeout, c.DialTimeout, c.TLSHandshakeTimeout, c.ResponseHeaderTimeout, c.IdleConnTimeout} {
+		if d.Duration < 0 {
+			return errors.New("http timeouts cannot be negative")
+		}
+	}
+	if c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		return errors.New("http connection limits cannot be negative")
+	}
+	return nil
+}
+
+// upstreamClient is the client shared by every request to one backend, so
+// connections are pooled and kept alive between heartbeats.
+type upstreamClient struct {
+	client     *http.Client
+	config     HTTPConfig
+	generation uint64
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = map[string]*upstreamClient{}
+)
+
+// clientFor returns the shared client for a backend, building it on first use
+// and again when the backend's http settings change.
+func clientFor(b Backend) *http.Client {
+	cfg := b.HTTP.withDefaults()
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	c, ok := clients[b.Name]
+	if ok && (c.config == cfg || b.generation < c.generation) {
+		return c.client
+	}
+	if ok {
+		c.client.CloseIdleConnections()
+	}
+	c = &upstreamClient{client: newUpstreamClient(cfg), config: cfg, generation: b.generation}
+	clients[b.Name] = c
+	return c.client
+}
+
+// closeClient drops a backend's client and its idle connections.
+func closeClient(name string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c, ok := clients[name]; ok {
+		c.client.CloseIdleConnections()
+		delete(clients, name)
+	}
+}
+
+func newUpstreamClient(cfg HTTPConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout.Duration, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout.Duration,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout.Duration,
+		IdleConnTimeout:       cfg.IdleConnTimeout.Duration,
+		MaxIdleConns:          cfg.MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Timeout:   cfg.Timeout.Duration,
+		Transport: drainingTransport{transport},
+	}
+}
+
+// maxDrain is how much of an unread response body is read on close so the
+// connection can be reused.
+const maxDrain = 64 << 10
+
+// drainingTransport makes closing a response body read what is left of it
+// first. Many callers only need the status, and a connection whose response
+// was not read to the end cannot go back to the pool.
+type drainingTransport struct {
+	http.RoundTripper
+}
+
+func (t drainingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = drainOnClose{resp.Body}
+	return resp, nil
+}
+
+// CloseIdleConnections lets http.Client reach the wrapped transport.
+func (t drainingTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type drainOnClose struct {
+	io.ReadCloser
+}
+
+func (b drainOnClose) Close() error {
+	io.Copy(io.Discard, io.LimitReader(b.ReadCloser, maxDrain))
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientFor(t *testing.T) {
+	b := Backend{Name: "Pooled", generation: 2}
+	t.Cleanup(func() { closeClient(b.Name) })
+
+	client := clientFor(b)
+	if clientFor(b) != client {
+		t.Error("Expected the same client for the same backend")
+	}
+	if client.Timeout != 10*time.Second {
+		t.Errorf("Expected the default 10s timeout, got %v", client.Timeout)
+	}
+
+	// A request still using an older config does not undo a change.
+	b.HTTP.Timeout = Duration{time.Second}
+	b.generation = 3
+	changed := clientFor(b)
+	if changed == client || changed.Timeout != time.Second {
+		t.Errorf("Expected a new client with a 1s timeout, got %v", changed.Timeout)
+	}
+	if clientFor(Backend{Name: "Pooled", generation: 2}) != changed {
+		t.Error("Expected an older config to keep the newer client")
+	}
+
+	closeClient(b.Name)
+	if clientFor(b) == changed {
+		t.Error("Expected a closed client to be rebuilt")
+	}
+}
+
+func TestClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.Repeat("x", 32<<10)))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	b := Backend{Name: "Reused", URL: server.URL, APIKey: "key"}
+	t.Cleanup(func() { closeClient(b.Name) })
+	for range 5 {
+		resp, err := forwardHeartbeat(context.Background(), []byte(`{}`), "test", "", b)
+		if err != nil {
+			t.Fatalf("Forward failed: %v", err)
+		}
+		// Closed without reading the body, as callers that only need the
+		// status do.
+		resp.Body.Close()
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected one connection to be reused, got %d", n)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	b := Backend{Name: "Slow", URL: server.URL, APIKey: "key", HTTP: HTTPConfig{ResponseHeaderTimeout: Duration{50 * time.Millisecond}}}
+	t.Cleanup(func() { closeClient(b.Name) })
+	if _, err := fetchStatusBar(context.Background(), "test", b); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected a response header timeout, got %v", err)
+	}
+}
+
+func TestHTTPConfigCheck(t *testing.T) {
+	if err := (HTTPConfig{}).check(); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+	if err := (HTTPConfig{DialTimeout: Duration{-time.Second}}).check(); err == nil {
+		t.Error("Expected a negative timeout to be rejected")
+	}
+	if err := (HTTPConfig{MaxConnsPerHost: -1}).check(); err == nil {
+		t.Error("Expected a negative connection limit to be rejected")
+	}
+}
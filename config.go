@@ -1,27 +1,120 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
 type Backend struct {
-	Name      string `toml:"name"`
-	URL       string `toml:"url"`
-	APIKey    string `toml:"api_key"`
-	IsPrimary bool   `toml:"is_primary"`
+	Name   string `toml:"name"`
+	URL    string `toml:"url"`
+	APIKey string `toml:"api_key"`
+	// The API key can instead be read from an environment variable, a file
+	// or the first line printed by a command.
+	APIKeyEnv  string `toml:"api_key_env"`
+	APIKeyFile string `toml:"api_key_file"`
+	APIKeyCmd  string `toml:"api_key_cmd"`
+	// AuthScheme is how the API key is sent: "basic" (the default),
+	// "bearer", "query" or "none". Headers are added to every request.
+	AuthScheme string            `toml:"auth_scheme"`
+	Headers    map[string]string `toml:"headers"`
+	IsPrimary  bool              `toml:"is_primary"`
+	Retry      RetryPolicy       `toml:"retry"`
+	Breaker    BreakerConfig     `toml:"circuit_breaker"`
+	Batch      BatchConfig       `toml:"batch"`
+	Rewrite    RewriteConfig     `toml:"rewrite"`
+	Routing    RoutingConfig     `toml:"routing"`
+	Privacy    PrivacyConfig     `toml:"privacy"`
+	HTTP       HTTPConfig        `toml:"http"`
+	// MaxBulkSize caps the number of heartbeats per bulk request; 0 means
+	// no limit.
+	MaxBulkSize int `toml:"max_bulk_size"`
+
+	// generation is the config snapshot the backend came from, so state
+	// is not rolled back by requests still using an older snapshot.
+	generation uint64
 }
 
 type Config struct {
-	Port     int       `toml:"port"`
-	Debug    bool      `toml:"debug"`
-	Backends []Backend `toml:"backends"`
+	Port      int    `toml:"port"`
+	Debug     bool   `toml:"debug"`
+	LogLevel  string `toml:"log_level"`
+	LogFormat string `toml:"log_format"`
+	LogFile   string `toml:"log_file"`
+	// The log file is rotated once it reaches LogMaxSizeMB, keeping
+	// LogMaxBackups old files.
+	LogMaxSizeMB  int      `toml:"log_max_size_mb"`
+	LogMaxBackups int      `toml:"log_max_backups"`
+	QueueDir      string   `toml:"queue_dir"`
+	AckMode       string   `toml:"ack_mode"`
+	ProbeInterval Duration `toml:"probe_interval"`
+	// ShutdownTimeout is how long to wait for forwards in flight on exit.
+	ShutdownTimeout Duration     `toml:"shutdown_timeout"`
+	Priority        []string     `toml:"priority"`
+	Dedup           DedupConfig  `toml:"dedup"`
+	Enrich          EnrichConfig `toml:"enrich"`
+	Admin           AdminConfig  `toml:"admin"`
+	Backends        []Backend    `toml:"backends"`
+}
+
+// Acknowledgement modes: answer the editor with a backend's response, or as
+// soon as the heartbeat is safely queued.
+const (
+	ackModeBackend = "backend"
+	ackModeLocal   = "local"
+)
+
+var (
+	configValue      atomic.Pointer[Config]
+	configGeneration atomic.Uint64
+)
+
+// currentConfig returns the active config snapshot. Snapshots are never
+// modified once published, so a request that reads it once sees a consistent
+// config even if it is reloaded meanwhile.
+func currentConfig() *Config {
+	return configValue.Load()
+}
+
+// setConfig publishes a new config snapshot.
+func setConfig(cfg *Config) {
+	generation := configGeneration.Add(1)
+	for i := range cfg.Backends {
+		cfg.Backends[i].generation = generation
+	}
+	configValue.Store(cfg)
 }
 
-var config *Config
+// Duration is a time.Duration written as a string such as "500ms" or "1m".
+type Duration struct {
+	time.Duration
+}
 
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// loadConfig reads and validates a config file. Problems with the contents
+// are reported together as configErrors.
 func loadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -29,23 +122,245 @@ func loadConfig(path string) (*Config, error) {
 	}
 
 	var cfg Config
-	if err := toml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
+	var problems configErrors
+	lines := locateKeys(data)
+
+	decoder := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		var strict *toml.StrictMissingError
+		var decodeErr *toml.DecodeError
+		switch {
+		case errors.As(err, &strict):
+			for _, e := range strict.Errors {
+				line, _ := e.Position()
+				problems = append(problems, configProblem{line, fmt.Sprintf("unknown key %q", strings.Join(e.Key(), "."))})
+			}
+		case errors.As(err, &decodeErr):
+			line, _ := decodeErr.Position()
+			return nil, configErrors{{line, decodeErr.Error()}}
+		default:
+			return nil, err
+		}
+	}
+	// Validating values with unset variables in them would only add noise.
+	if missing := interpolateEnv(&cfg, lines); len(missing) > 0 {
+		return nil, append(problems, missing...)
+	}
+	problem := func(line int, format string, args ...any) {
+		problems = append(problems, configProblem{line, fmt.Sprintf(format, args...)})
 	}
 
 	if cfg.Port == 0 {
 		cfg.Port = 3000
 	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		problem(lines.of("port"), "port must be between 1 and 65535")
+	}
 
+	switch cfg.AckMode {
+	case "":
+		cfg.AckMode = ackModeBackend
+	case ackModeBackend, ackModeLocal:
+	default:
+		problem(lines.of("ack_mode"), "ack_mode must be %q or %q", ackModeBackend, ackModeLocal)
+	}
+
+	switch {
+	case cfg.ProbeInterval.Duration == 0:
+		cfg.ProbeInterval.Duration = defaultProbeInterval
+	case cfg.ProbeInterval.Duration < time.Second:
+		problem(lines.of("probe_interval"), "probe_interval must be at least 1s")
+	}
+
+	switch {
+	case cfg.ShutdownTimeout.Duration == 0:
+		cfg.ShutdownTimeout.Duration = defaultShutdownTimeout
+	case cfg.ShutdownTimeout.Duration < 0:
+		problem(lines.of("shutdown_timeout"), "shutdown_timeout cannot be negative")
+	}
+
+	if cfg.LogLevel != "" {
+		if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+			problem(lines.of("log_level"), "%v", err)
+		}
+	}
+	switch cfg.LogFormat {
+	case "":
+		cfg.LogFormat = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		problem(lines.of("log_format"), "log_format must be %q or %q", logFormatText, logFormatJSON)
+	}
+	if cfg.LogMaxSizeMB < 0 {
+		problem(lines.of("log_max_size_mb"), "log_max_size_mb cannot be negative")
+	} else if cfg.LogMaxSizeMB == 0 {
+		cfg.LogMaxSizeMB = defaultLogMaxSizeMB
+	}
+	if cfg.LogMaxBackups < 0 {
+		problem(lines.of("log_max_backups"), "log_max_backups cannot be negative")
+	} else if cfg.LogMaxBackups == 0 {
+		cfg.LogMaxBackups = defaultLogMaxBackups
+	}
+
+	if err := cfg.Admin.check(); err != nil {
+		problem(lines.of("admin.listen", "admin.token", "admin"), "%v", err)
+	}
+	secrets.add(cfg.Admin.Token)
+
+	if err := cfg.Enrich.compile(); err != nil {
+		problem(lines.of("enrich.machine_aliases", "enrich"), "enrich: %v", err)
+	}
+
+	if cfg.QueueDir == "" {
+		cfg.QueueDir = defaultQueueDir()
+	}
+
+	if len(cfg.Backends) == 0 {
+		problem(0, "at least one backend must be configured")
+	}
 	primaryCount := 0
-	for _, b := range cfg.Backends {
+	names := make(map[string]bool, len(cfg.Backends))
+	for i := range cfg.Backends {
+		b := &cfg.Backends[i]
+
+		switch {
+		case b.Name == "":
+			problem(lines.backend(i, ""), "backend %d has no name", i+1)
+		case names[b.Name]:
+			problem(lines.backend(i, "name"), "backend name %q is used more than once", b.Name)
+		}
+		names[b.Name] = true
+
+		// Normalize the URL so paths can be appended to it.
+		b.URL = strings.TrimRight(b.URL, "/")
+		if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem(lines.backend(i, "url"), "backend %q: url must be an http or https URL, got %q", b.Name, b.URL)
+		}
+
+		if err := resolveAPIKey(b); err != nil {
+			problem(lines.of(
+				"backends."+strconv.Itoa(i)+".api_key_env",
+				"backends."+strconv.Itoa(i)+".api_key_file",
+				"backends."+strconv.Itoa(i)+".api_key_cmd",
+				"backends."+strconv.Itoa(i),
+			), "backend %q: %v", b.Name, err)
+		} else if b.APIKey == "" && b.AuthScheme != authNone {
+			problem(lines.backend(i, "api_key"), "backend %q: api_key is empty", b.Name)
+		}
+		secrets.add(b.APIKey)
+
+		if err := checkAuth(*b); err != nil {
+			problem(lines.of(
+				"backends."+strconv.Itoa(i)+".auth_scheme",
+				"backends."+strconv.Itoa(i)+".headers",
+				"backends."+strconv.Itoa(i),
+			), "backend %q: %v", b.Name, err)
+		}
+		// Headers that carry credentials are redacted like API keys. Others
+		// are not, since short values like "https" would mangle every log.
+		for name, value := range b.Headers {
+			if credentialHeader(name) {
+				secrets.add(value)
+			}
+		}
+
 		if b.IsPrimary {
 			primaryCount++
 		}
+		if b.MaxBulkSize < 0 {
+			problem(lines.backend(i, "max_bulk_size"), "backend %q: max_bulk_size cannot be negative", b.Name)
+		}
+		if err := b.HTTP.check(); err != nil {
+			problem(lines.backend(i, "http"), "backend %q: %v", b.Name, err)
+		}
+		if b.Retry.Jitter < 0 || b.Retry.Jitter > 1 {
+			problem(lines.backend(i, "retry.jitter"), "backend %q: retry jitter must be between 0 and 1", b.Name)
+		}
+		if _, err := compileRules(*b); err != nil {
+			problem(lines.backend(i, ""), "backend %q: %v", b.Name, err)
+		}
+	}
+	if len(cfg.Priority) == 0 && primaryCount != 1 && len(cfg.Backends) > 0 {
+		problem(0, "exactly one backend must be marked as primary")
 	}
-	if primaryCount != 1 {
-		return nil, fmt.Errorf("exactly one backend must be marked as primary")
+	if len(cfg.Priority) > 0 {
+		if err := checkPriority(&cfg, primaryCount); err != nil {
+			problem(lines.of("priority"), "%v", err)
+		}
 	}
 
+	if len(problems) > 0 {
+		return nil, problems
+	}
 	return &cfg, nil
 }
+
+// checkPriority validates the priority list against the configured backends.
+func checkPriority(cfg *Config, primaryCount int) error {
+	names := make(map[string]bool, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		names[b.Name] = true
+	}
+
+	seen := make(map[string]bool, len(cfg.Priority))
+	for _, name := range cfg.Priority {
+		if !names[name] {
+			return fmt.Errorf("priority lists unknown backend %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("priority lists backend %q more than once", name)
+		}
+		seen[name] = true
+	}
+
+	if primaryCount > 1 {
+		return fmt.Errorf("at most one backend can be marked as primary")
+	}
+	for _, b := range cfg.Backends {
+		if b.IsPrimary && b.Name != cfg.Priority[0] {
+			return fmt.Errorf("primary backend %q must come first in priority", b.Name)
+		}
+	}
+	return nil
+}
+
+// responders returns the backends allowed to answer the client, most
+// preferred first. Without a priority list that is the primary followed by
+// the remaining backends in configuration order.
+func (c *Config) responders() []Backend {
+	byName := make(map[string]Backend, len(c.Backends))
+	for _, b := range c.Backends {
+		byName[b.Name] = b
+	}
+
+	var order []Backend
+	if len(c.Priority) > 0 {
+		for _, name := range c.Priority {
+			if b, ok := byName[name]; ok {
+				order = append(order, b)
+			}
+		}
+		return order
+	}
+
+	for _, b := range c.Backends {
+		if b.IsPrimary {
+			order = append(order, b)
+		}
+	}
+	for _, b := range c.Backends {
+		if !b.IsPrimary {
+			order = append(order, b)
+		}
+	}
+	return order
+}
+
+// defaultQueueDir is where outboxes live when queue_dir is not configured.
+func defaultQueueDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "multitime-queue"
+	}
+	return filepath.Join(dir, "multitime", "queue")
+}
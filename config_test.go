@@ -90,6 +90,89 @@ name = "Backend 2"
 url = "https://example2.com/api"
 api_key = "key2"
 is_primary = true
+`,
+			expectError: true,
+		},
+		{
+			name: "Priority list without a primary backend",
+			configContent: `
+priority = ["Backend 2", "Backend 1"]
+
+[[backends]]
+name = "Backend 1"
+url = "https://example.com/api"
+api_key = "key1"
+
+[[backends]]
+name = "Backend 2"
+url = "https://example2.com/api"
+api_key = "key2"
+`,
+			expectError:  false,
+			expectedPort: 3000,
+			backendCount: 2,
+		},
+		{
+			name: "Priority list naming an unknown backend",
+			configContent: `
+priority = ["Backend 1", "Backend 3"]
+
+[[backends]]
+name = "Backend 1"
+url = "https://example.com/api"
+api_key = "key1"
+is_primary = true
+`,
+			expectError: true,
+		},
+		{
+			name: "Routing rules",
+			configContent: `
+[[backends]]
+name = "Backend 1"
+url = "https://example.com/api"
+api_key = "key1"
+is_primary = true
+
+[backends.routing.include]
+projects = ["acme-*"]
+
+[backends.routing.exclude]
+branches = ["^personal/"]
+`,
+			expectError:  false,
+			expectedPort: 3000,
+			backendCount: 1,
+		},
+		{
+			name: "Invalid routing branch pattern",
+			configContent: `
+[[backends]]
+name = "Backend 1"
+url = "https://example.com/api"
+api_key = "key1"
+is_primary = true
+
+[backends.routing.exclude]
+branches = ["("]
+`,
+			expectError: true,
+		},
+		{
+			name: "Primary backend not first in priority",
+			configContent: `
+priority = ["Backend 2", "Backend 1"]
+
+[[backends]]
+name = "Backend 1"
+url = "https://example.com/api"
+api_key = "key1"
+is_primary = true
+
+[[backends]]
+name = "Backend 2"
+url = "https://example2.com/api"
+api_key = "key2"
 `,
 			expectError: true,
 		},
@@ -139,7 +222,13 @@ is_primary = true
 				t.Errorf("Expected %d backends, got %d", tc.backendCount, len(cfg.Backends))
 			}
 
-			// Verify one and only one primary backend
+			// Without a priority list there must be exactly one primary backend
+			if len(cfg.Priority) > 0 {
+				if cfg.responders()[0].Name != cfg.Priority[0] {
+					t.Errorf("Expected %s to answer first, got %s", cfg.Priority[0], cfg.responders()[0].Name)
+				}
+				return
+			}
 			primaryCount := 0
 			for _, b := range cfg.Backends {
 				if b.IsPrimary {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dashboardPage is the single page served at /dashboard on the admin
+// listener. It holds no data itself: it asks for the admin token and polls
+// the admin API with it.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// tailLimit is how many recent heartbeats the dashboard can show.
+const tailLimit = 200
+
+// tailEvent is a heartbeat received from a client, as shown in the
+// dashboard's live tail.
+type tailEvent struct {
+	Seq      uint64    `json:"seq"`
+	Received time.Time `json:"received"`
+	Entity   string    `json:"entity"`
+	Type     string    `json:"type"`
+	Category string    `json:"category,omitempty"`
+	Project  string    `json:"project,omitempty"`
+	Branch   string    `json:"branch,omitempty"`
+	Language string    `json:"language,omitempty"`
+	// Backends names the backends the heartbeat is sent or queued to.
+	Backends []string `json:"backends"`
+}
+
+// heartbeatTail keeps the most recent heartbeats in memory.
+type heartbeatTail struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []tailEvent
+}
+
+var tail = &heartbeatTail{}
+
+// record adds the heartbeats of a request, noting which backends each one is
+// delivered to.
+func (t *heartbeatTail) record(heartbeats []Heartbeat, deliveries []delivery) {
+	backends := make([][]string, len(heartbeats))
+	for _, d := range deliveries {
+		if d.skipped != nil {
+			continue
+		}
+		for _, i := range d.indices {
+			backends[i] = append(backends[i], d.backend.Name)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for i, h := range heartbeats {
+		t.seq++
+		t.events = append(t.events, tailEvent{
+			Seq:      t.seq,
+			Received: now,
+			Entity:   h.Entity,
+			Type:     h.Type,
+			Category: h.Category,
+			Project:  h.Project,
+			Branch:   h.Branch,
+			Language: h.Language,
+			Backends: backends[i],
+		})
+	}
+	if len(t.events) > tailLimit {
+		t.events = append(t.events[:0:0], t.events[len(t.events)-tailLimit:]...)
+	}
+}
+
+// since returns the heartbeats recorded after seq, oldest first. A seq from
+// before a restart returns everything.
+func (t *heartbeatTail) since(seq uint64) []tailEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq > t.seq {
+		seq = 0
+	}
+	events := []tailEvent{}
+	for _, e := range t.events {
+		if e.Seq > seq {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// handleDashboard serves the dashboard page.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Write(dashboardPage)
+}
+
+// handleAdminHeartbeats lists the heartbeats received after the "after"
+// sequence number, for the dashboard's live tail.
+func handleAdminHeartbeats(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorBody("Invalid after"))
+			return
+		}
+	}
+	payload, err := json.Marshal(tail.since(after))
+	if err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHeartbeatTail(t *testing.T) {
+	tl := &heartbeatTail{}
+	heartbeats := []Heartbeat{{Entity: "a.go"}, {Entity: "b.go"}}
+	tl.record(heartbeats, []delivery{
+		{backend: Backend{Name: "Primary"}, indices: []int{0, 1}},
+		{backend: Backend{Name: "Secondary"}, indices: []int{1}},
+		{backend: Backend{Name: "Disabled"}, skipped: errDisabled},
+	})
+
+	events := tl.since(0)
+	if len(events) != 2 || events[0].Entity != "a.go" || events[1].Seq != 2 {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+	if !slices.Equal(events[0].Backends, []string{"Primary"}) || !slices.Equal(events[1].Backends, []string{"Primary", "Secondary"}) {
+		t.Errorf("Unexpected backends: %v and %v", events[0].Backends, events[1].Backends)
+	}
+	if events := tl.since(1); len(events) != 1 || events[0].Entity != "b.go" {
+		t.Errorf("Expected only the second heartbeat after seq 1, got %+v", events)
+	}
+	if events := tl.since(2); len(events) != 0 {
+		t.Errorf("Expected nothing after the last seq, got %+v", events)
+	}
+	// A seq from before a restart starts over.
+	if events := tl.since(99); len(events) != 2 {
+		t.Errorf("Expected every heartbeat for an unknown seq, got %d", len(events))
+	}
+
+	for i := range tailLimit {
+		tl.record([]Heartbeat{{Entity: fmt.Sprintf("%d.go", i)}}, nil)
+	}
+	events = tl.since(0)
+	if len(events) != tailLimit || events[0].Entity != "0.go" || events[len(events)-1].Seq != tailLimit+2 {
+		t.Errorf("Expected the tail to keep the last %d heartbeats, got %d starting with %q", tailLimit, len(events), events[0].Entity)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	resetMetrics()
+	cfg := setupTestConfig(t)
+	cfg.Admin = AdminConfig{Listen: "127.0.0.1:3001", Token: "admin-token"}
+	tail = &heartbeatTail{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	cfg.Backends[0].URL = server.URL
+	cfg.Backends[1].URL = "http://127.0.0.1:1"
+	cfg.Backends[1].Retry = RetryPolicy{MaxAttempts: 1}
+
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", strings.NewReader(`{"entity":"main.go","type":"file","project":"multitime","time":1700000000}`))
+	handleHeartbeat(httptest.NewRecorder(), req)
+	detached.Wait()
+
+	admin := adminHandler()
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The page itself needs no token, the data behind it does.
+	if rr := get("/dashboard", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<title>MultiTime</title>") {
+		t.Errorf("Expected the dashboard page, got %d", rr.Code)
+	}
+	if rr := get("/admin/heartbeats", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", rr.Code)
+	}
+
+	var events []tailEvent
+	json.Unmarshal(get("/admin/heartbeats?after=0", "admin-token").Body.Bytes(), &events)
+	if len(events) != 1 || events[0].Entity != "main.go" || events[0].Project != "multitime" || len(events[0].Backends) != 2 {
+		t.Errorf("Unexpected tail: %+v", events)
+	}
+	if rr := get("/admin/heartbeats?after=x", "admin-token"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid after, got %d", rr.Code)
+	}
+
+	var statuses []backendStatus
+	json.Unmarshal(get("/admin/backends", "admin-token").Body.Bytes(), &statuses)
+	if len(statuses) != 2 {
+		t.Fatalf("Expected two backends, got %+v", statuses)
+	}
+	if statuses[0].Forwarded != 1 || statuses[0].Failed != 0 || len(statuses[0].RecentErrors) != 0 {
+		t.Errorf("Unexpected primary status: %+v", statuses[0])
+	}
+	if statuses[1].Forwarded != 0 || statuses[1].Failed != 1 || len(statuses[1].RecentErrors) != 1 || statuses[1].LastError != statuses[1].RecentErrors[0].Message {
+		t.Errorf("Unexpected secondary status: %+v", statuses[1])
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	s := &backendState{}
+	for i := range recentErrorLimit + 3 {
+		s.setLastError(fmt.Sprintf("error %d", i))
+	}
+	errs := s.recentErrors()
+	if len(errs) != recentErrorLimit || errs[0].Message != fmt.Sprintf("error %d", recentErrorLimit+2) || errs[len(errs)-1].Message != "error 3" {
+		t.Errorf("Expected the newest %d errors first, got %+v", recentErrorLimit, errs)
+	}
+}
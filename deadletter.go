@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	errNoDeadLetters     = errors.New("dead letters unavailable")
+	errDeadLetterMissing = errors.New("no such dead letter")
+)
+
+func rejectedReason(status int) string {
+	return fmt.Sprintf("rejected with %d %s", status, http.StatusText(status))
+}
+
+// deadLetter keeps an entry the backend rejected, so it can be inspected and
+// requeued or dropped through the admin API instead of being lost.
+func (s *backendState) deadLetter(e Entry, reason string) {
+	s.setLastError(reason)
+	if s.dead == nil {
+		return
+	}
+	e.ID, e.Reason = 0, reason
+	stored, err := s.dead.Append(e)
+	if err != nil {
+		slog.Error("Could not store dead letter", "backend", s.current().Name, "error", err)
+		return
+	}
+	s.dead.Release(stored.ID)
+}
+
+// deadLetters returns the entries the backend rejected, oldest first.
+func (s *backendState) deadLetters() []Entry {
+	if s.dead == nil {
+		return nil
+	}
+	return s.dead.Entries()
+}
+
+// requeueDeadLetters moves dead letters back into the outbox to be sent
+// again. With no ids, every dead letter is requeued. It returns how many were.
+func (s *backendState) requeueDeadLetters(ids ...uint64) (int, error) {
+	return s.settleDeadLetters(ids, func(e Entry) error {
+		e.ID, e.Reason, e.Queued = 0, "", time.Time{}
+		return s.enqueue(e)
+	})
+}
+
+// dropDeadLetters discards dead letters. With no ids, every dead letter is
+// dropped. It returns how many were.
+func (s *backendState) dropDeadLetters(ids ...uint64) (int, error) {
+	return s.settleDeadLetters(ids, func(Entry) error { return nil })
+}
+
+func (s *backendState) settleDeadLetters(ids []uint64, apply func(Entry) error) (int, error) {
+	if s.dead == nil {
+		return 0, errNoDeadLetters
+	}
+
+	var entries []Entry
+	if len(ids) == 0 {
+		entries = s.dead.Entries()
+	}
+	for _, id := range ids {
+		e, ok := s.dead.Get(id)
+		if !ok {
+			return 0, errDeadLetterMissing
+		}
+		entries = append(entries, e)
+	}
+
+	for i, e := range entries {
+		if err := apply(e); err != nil {
+			return i, err
+		}
+		if err := s.dead.Ack(e.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
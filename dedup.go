@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDuplicate is reported for a backend that already received every
+// heartbeat in a request.
+var errDuplicate = errors.New("already forwarded")
+
+// DedupConfig bounds the window in which duplicate heartbeats are detected.
+type DedupConfig struct {
+	Disabled   bool     `toml:"disabled"`
+	Window     Duration `toml:"window"`
+	MaxEntries int      `toml:"max_entries"`
+}
+
+func (c DedupConfig) withDefaults() DedupConfig {
+	if c.Window.Duration <= 0 {
+		c.Window.Duration = 24 * time.Hour
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 100000
+	}
+	return c
+}
+
+// heartbeatKey identifies a heartbeat for deduplication purposes.
+func heartbeatKey(h Heartbeat) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		h.Entity,
+		strconv.FormatFloat(h.Time, 'f', -1, 64),
+		strconv.FormatBool(h.IsWrite),
+		h.Project,
+		h.Branch,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+const (
+	dedupQueued    = 'q'
+	dedupDelivered = 'd'
+)
+
+type dedupEntry struct {
+	state byte
+	seen  time.Time
+}
+
+// dedupWindow remembers which heartbeats were queued for and delivered to a
+// backend. It is kept in memory and mirrored to an append-only file so the
+// window survives restarts. Entries older than the window, or beyond
+// MaxEntries, are forgotten oldest first.
+type dedupWindow struct {
+	path string
+	cfg  DedupConfig
+	now  func() time.Time
+
+	mu    sync.Mutex
+	file  *os.File
+	seen  map[string]dedupEntry
+	order []string
+	lines int
+}
+
+func openDedupWindow(dir string, cfg DedupConfig) (*dedupWindow, error) {
+	d := &dedupWindow{
+		path: filepath.Join(dir, "dedup.log"),
+		cfg:  cfg.withDefaults(),
+		now:  time.Now,
+		seen: make(map[string]dedupEntry),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	if err := d.rewrite(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the on-disk window. Malformed lines are skipped.
+func (d *dedupWindow) load() error {
+	f, err := os.Open(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var state byte
+		var key string
+		var unix int64
+		if _, err := fmt.Sscanf(scanner.Text(), "%c %s %d", &state, &key, &unix); err != nil {
+			continue
+		}
+		d.remember(key, dedupEntry{state: state, seen: time.Unix(unix, 0)})
+	}
+	d.evict()
+	return scanner.Err()
+}
+
+// rewrite replaces the on-disk window with the current in-memory one.
+func (d *dedupWindow) rewrite() error {
+	tmp := d.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range d.order {
+		e := d.seen[key]
+		fmt.Fprintf(w, "%c %s %d\n", e.state, key, e.seen.Unix())
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.path); err != nil {
+		return err
+	}
+
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file, err = os.OpenFile(d.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	d.lines = len(d.order)
+	return err
+}
+
+func (d *dedupWindow) remember(key string, e dedupEntry) {
+	if _, ok := d.seen[key]; !ok {
+		d.order = append(d.order, key)
+	}
+	d.seen[key] = e
+}
+
+// evict forgets entries that fell out of the window.
+func (d *dedupWindow) evict() {
+	cutoff := d.now().Add(-d.cfg.Window.Duration)
+	drop := 0
+	for drop < len(d.order) {
+		key := d.order[drop]
+		if len(d.order)-drop <= d.cfg.MaxEntries && !d.seen[key].seen.Before(cutoff) {
+			break
+		}
+		delete(d.seen, key)
+		drop++
+	}
+	d.order = d.order[drop:]
+}
+
+// record appends state changes to the file and compacts it once it holds
+// mostly stale lines.
+func (d *dedupWindow) record(keys []string, state byte) error {
+	now := d.now()
+	var buf strings.Builder
+	for _, key := range keys {
+		d.remember(key, dedupEntry{state: state, seen: now})
+		fmt.Fprintf(&buf, "%c %s %d\n", state, key, now.Unix())
+	}
+	d.evict()
+
+	if _, err := d.file.WriteString(buf.String()); err != nil {
+		return err
+	}
+	d.lines += len(keys)
+	if d.lines > 2*len(d.order)+1000 {
+		return d.rewrite()
+	}
+	return d.file.Sync()
+}
+
+// admit returns, for each key, whether it is new. New keys are recorded as
+// queued so later duplicates are refused.
+func (d *dedupWindow) admit(keys []string) ([]bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict()
+
+	fresh := make([]bool, len(keys))
+	var added []string
+	pending := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if _, ok := d.seen[key]; ok || pending[key] {
+			continue
+		}
+		fresh[i] = true
+		pending[key] = true
+		added = append(added, key)
+	}
+	if len(added) == 0 {
+		return fresh, nil
+	}
+	return fresh, d.record(added, dedupQueued)
+}
+
+// markDelivered records that the backend accepted these heartbeats.
+func (d *dedupWindow) markDelivered(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.record(keys, dedupDelivered)
+}
+
+// delivered reports whether the backend already accepted this heartbeat.
+func (d *dedupWindow) delivered(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seen[key].state == dedupDelivered
+}
+
+func (d *dedupWindow) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
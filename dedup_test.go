@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupWindowAdmit(t *testing.T) {
+	dir := t.TempDir()
+	d, err := openDedupWindow(dir, DedupConfig{})
+	if err != nil {
+		t.Fatalf("Failed to open dedup window: %v", err)
+	}
+
+	fresh, err := d.admit([]string{"a", "b", "a"})
+	if err != nil {
+		t.Fatalf("admit returned error: %v", err)
+	}
+	if !fresh[0] || !fresh[1] || fresh[2] {
+		t.Errorf("Expected a and b to be new once, got %v", fresh)
+	}
+	if err := d.markDelivered([]string{"a"}); err != nil {
+		t.Fatalf("markDelivered returned error: %v", err)
+	}
+	d.Close()
+
+	// The window survives a restart.
+	d, err = openDedupWindow(dir, DedupConfig{})
+	if err != nil {
+		t.Fatalf("Failed to reopen dedup window: %v", err)
+	}
+	defer d.Close()
+	fresh, _ = d.admit([]string{"a", "b", "c"})
+	if fresh[0] || fresh[1] || !fresh[2] {
+		t.Errorf("Expected only c to be new after reopening, got %v", fresh)
+	}
+	if !d.delivered("a") || d.delivered("b") {
+		t.Error("Expected only a to be delivered after reopening")
+	}
+}
+
+func TestDedupWindowEviction(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d, err := openDedupWindow(t.TempDir(), DedupConfig{Window: Duration{time.Hour}, MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("Failed to open dedup window: %v", err)
+	}
+	defer d.Close()
+	d.now = func() time.Time { return now }
+
+	d.admit([]string{"a", "b", "c"})
+	if fresh, _ := d.admit([]string{"a"}); !fresh[0] {
+		t.Error("Expected the oldest key to be evicted beyond max_entries")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if fresh, _ := d.admit([]string{"c"}); !fresh[0] {
+		t.Error("Expected keys older than the window to be evicted")
+	}
+}
+
+func TestHandleHeartbeatsBulkDeduplicates(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var mu sync.Mutex
+	var forwarded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var heartbeats []Heartbeat
+		json.NewDecoder(r.Body).Decode(&heartbeats)
+		responses := make([]bulkItem, len(heartbeats))
+		mu.Lock()
+		for i, h := range heartbeats {
+			forwarded = append(forwarded, h.Entity)
+			responses[i] = bulkItem{Body: json.RawMessage(`{"data":{"entity":"` + h.Entity + `"}}`), Status: http.StatusCreated}
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(bulkResponse{Responses: responses})
+	}))
+	defer server.Close()
+	cfg.Backends = cfg.Backends[:1]
+	cfg.Backends[0].URL = server.URL
+
+	send := func(body string) string {
+		req, _ := http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		handleHeartbeatsBulk(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+		}
+		return rr.Body.String()
+	}
+
+	send(`[{"entity":"a.go","type":"file","time":1700000000}]`)
+	got := send(`[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]`)
+
+	if len(forwarded) != 2 || forwarded[0] != "a.go" || forwarded[1] != "b.go" {
+		t.Errorf("Expected each heartbeat to be forwarded once, got %v", forwarded)
+	}
+	expected := `{"responses":[[{"data":{"entity":"a.go","type":"file","time":1700000000}},201],[{"data":{"entity":"b.go"}},201]]}`
+	if got != expected {
+		t.Errorf("Handler returned unexpected body: got %v want %v", got, expected)
+	}
+
+	// A request made up only of duplicates is answered locally.
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"b.go","type":"file","time":1700000000}`)))
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+	if rr.Code != http.StatusCreated || len(forwarded) != 2 {
+		t.Errorf("Expected a local 201 without forwarding, got %d after %v", rr.Code, forwarded)
+	}
+}
+
+func TestFlushSkipsDeliveredHeartbeats(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var forwarded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var heartbeats []Heartbeat
+		json.NewDecoder(r.Body).Decode(&heartbeats)
+		for _, h := range heartbeats {
+			forwarded = append(forwarded, h.Entity)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	s := stateFor(addTestBackend(cfg, Backend{Name: "Replay Backend", URL: server.URL}))
+	a := Heartbeat{Entity: "a.go", Type: "file", Time: 1700000000}
+	s.dedup.markDelivered([]string{heartbeatKey(a)})
+
+	// Simulate a crash between delivery and acknowledgement.
+	e, _ := s.outbox.Append(Entry{Bulk: true, Body: json.RawMessage(`[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]`)})
+	s.outbox.Release(e.ID)
+	s.flush()
+
+	if len(forwarded) != 1 || forwarded[0] != "b.go" {
+		t.Errorf("Expected only b.go to be replayed, got %v", forwarded)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// machineHeader is the header WakaTime clients use to name the machine a
+// heartbeat came from.
+const machineHeader = "X-Machine-Name"
+
+// EnrichConfig fills in details that editors leave out or get wrong before
+// heartbeats are sent to any backend.
+type EnrichConfig struct {
+	// MachineName replaces the machine name reported by the client.
+	MachineName string `toml:"machine_name"`
+	// MachineAliases rename reported machine names, e.g. the random
+	// hostnames of dev containers; the first matching pattern applies.
+	MachineAliases []PatternRewrite `toml:"machine_aliases"`
+	// ProjectFromGit sets a missing project to the name of the git
+	// repository containing the file.
+	ProjectFromGit bool `toml:"project_from_git"`
+	// BranchFromGit sets a missing branch from the repository's .git/HEAD.
+	BranchFromGit bool `toml:"branch_from_git"`
+
+	// aliases are the compiled MachineAliases.
+	aliases []compiledRewrite
+}
+
+// compile compiles the machine aliases; it is done once when the config is
+// loaded.
+func (c *EnrichConfig) compile() error {
+	aliases, err := compileRewrites("machine_aliases", c.MachineAliases)
+	if err != nil {
+		return err
+	}
+	c.aliases = aliases
+	return nil
+}
+
+// machineName returns the machine name to send to backends for a request
+// that reported the given one.
+func (c EnrichConfig) machineName(reported string) string {
+	if c.MachineName != "" {
+		return c.MachineName
+	}
+	return applyRewrites(c.aliases, reported)
+}
+
+// enrich fills in missing projects and branches from the git repository of
+// each file. This only works for files on the machine multitime runs on.
+func (c EnrichConfig) enrich(heartbeats []Heartbeat) {
+	if !c.ProjectFromGit && !c.BranchFromGit {
+		return
+	}
+	for i := range heartbeats {
+		h := &heartbeats[i]
+		if h.Type != "file" || !filepath.IsAbs(h.Entity) || (h.Project != "" && h.Branch != "") {
+			continue
+		}
+		root, gitDir, ok := findGitRepo(h.Entity)
+		if !ok {
+			continue
+		}
+		if c.ProjectFromGit && h.Project == "" {
+			h.Project = filepath.Base(root)
+		}
+		if c.BranchFromGit && h.Branch == "" {
+			h.Branch = gitBranch(gitDir)
+		}
+	}
+}
+
+// findGitRepo walks up from a file to the root of the git repository that
+// contains it and returns the root and its git directory.
+func findGitRepo(entity string) (root, gitDir string, ok bool) {
+	dir := filepath.Dir(entity)
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if info.IsDir() {
+				return dir, dotGit, true
+			}
+			// Worktrees and submodules have a .git file pointing at the git
+			// directory.
+			data, err := os.ReadFile(dotGit)
+			if err != nil {
+				return "", "", false
+			}
+			target, found := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+			if !found {
+				return "", "", false
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(dir, target)
+			}
+			return dir, target, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// gitBranch returns the branch checked out in a git directory, or "" for a
+// detached HEAD.
+func gitBranch(gitDir string) string {
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	branch, found := strings.CutPrefix(strings.TrimSpace(string(data)), "ref: refs/heads/")
+	if !found {
+		return ""
+	}
+	return branch
+}
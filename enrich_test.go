@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnrichMachineName(t *testing.T) {
+	c := EnrichConfig{MachineAliases: []PatternRewrite{{Pattern: `^codespaces-.*$`, Replace: "codespace"}}}
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile returned error: %v", err)
+	}
+	if got := c.machineName("codespaces-a1b2c3"); got != "codespace" {
+		t.Errorf("Expected the alias to apply, got %s", got)
+	}
+	if got := c.machineName("laptop"); got != "laptop" {
+		t.Errorf("Expected other machine names to be kept, got %s", got)
+	}
+
+	c.MachineName = "devbox"
+	if got := c.machineName("codespaces-a1b2c3"); got != "devbox" {
+		t.Errorf("Expected machine_name to override, got %s", got)
+	}
+}
+
+func TestEnrichFromGit(t *testing.T) {
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "multitime")
+	os.MkdirAll(filepath.Join(repo, ".git"), 0o755)
+	os.MkdirAll(filepath.Join(repo, "cmd"), 0o755)
+	os.WriteFile(filepath.Join(repo, ".git", "HEAD"), []byte("ref: refs/heads/feature/enrich\n"), 0o644)
+
+	// A worktree points at its git directory from a .git file.
+	worktree := filepath.Join(dir, "wt")
+	os.MkdirAll(filepath.Join(dir, "gitdirs", "wt"), 0o755)
+	os.MkdirAll(worktree, 0o755)
+	os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: ../gitdirs/wt\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "gitdirs", "wt", "HEAD"), []byte("0123456789abcdef\n"), 0o644)
+
+	heartbeats := []Heartbeat{
+		{Entity: filepath.Join(repo, "cmd", "main.go"), Type: "file"},
+		{Entity: filepath.Join(repo, "main.go"), Type: "file", Project: "kept", Branch: "kept"},
+		{Entity: filepath.Join(worktree, "main.go"), Type: "file"},
+		{Entity: filepath.Join(dir, "loose.go"), Type: "file"},
+		{Entity: "main.go", Type: "file"},
+	}
+	EnrichConfig{ProjectFromGit: true, BranchFromGit: true}.enrich(heartbeats)
+
+	expected := []struct{ project, branch string }{
+		{"multitime", "feature/enrich"},
+		{"kept", "kept"},
+		{"wt", ""},
+		{"", ""},
+		{"", ""},
+	}
+	for i, e := range expected {
+		if heartbeats[i].Project != e.project || heartbeats[i].Branch != e.branch {
+			t.Errorf("Heartbeat %d: expected project %q and branch %q, got %q and %q", i, e.project, e.branch, heartbeats[i].Project, heartbeats[i].Branch)
+		}
+	}
+}
+
+func TestHandleHeartbeatEnrichment(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	repo := filepath.Join(t.TempDir(), "site")
+	os.MkdirAll(filepath.Join(repo, ".git"), 0o755)
+	os.WriteFile(filepath.Join(repo, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0o644)
+
+	var machine string
+	var forwarded Heartbeat
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		machine = r.Header.Get("X-Machine-Name")
+		json.NewDecoder(r.Body).Decode(&forwarded)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	cfg.Backends = cfg.Backends[:1]
+	cfg.Backends[0].URL = server.URL
+	cfg.Enrich = EnrichConfig{
+		MachineAliases: []PatternRewrite{{Pattern: `^[0-9a-f]{12}$`, Replace: "container"}},
+		ProjectFromGit: true,
+	}
+	cfg.Enrich.compile()
+
+	body, _ := json.Marshal(Heartbeat{Entity: filepath.Join(repo, "index.html"), Type: "file", Time: 1700000000})
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader(body))
+	req.Header.Set("X-Machine-Name", "3f2a9c1b7d4e")
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+
+	if machine != "container" {
+		t.Errorf("Expected the machine alias to be sent, got %q", machine)
+	}
+	if forwarded.Project != "site" || forwarded.Branch != "" {
+		t.Errorf("Expected only the project to be filled in, got %+v", forwarded)
+	}
+}
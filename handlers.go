@@ -1,252 +1,454 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
-	"sync"
 	"time"
 )
 
+// backendHeader names the backend whose response was relayed to the client.
+const backendHeader = "X-Multitime-Backend"
+
+// emptyStatusBar is returned when no backend can answer a status bar request.
+const emptyStatusBar = `{"data":{"grand_total":{"decimal":"","digital":"","hours":0,"minutes":0,"text":"","total_seconds":0},"categories":[],"dependencies":[],"editors":[],"languages":[],"machines":[],"operating_systems":[],"projects":[],"range":{"text":"Today","timezone":"UTC"}}}`
+
+// forwardResult is the outcome of forwarding a request to one backend.
+type forwardResult struct {
+	resp    *http.Response
+	err     error
+	backend Backend
+	// indices maps the heartbeats sent to the backend to their positions
+	// among the valid heartbeats of the request.
+	indices []int
+}
+
+// usable reports whether the response can be relayed to the client.
+func (r forwardResult) usable() bool {
+	return r.err == nil && r.resp.StatusCode < http.StatusInternalServerError
+}
+
 func handleStatusBar(w http.ResponseWriter, r *http.Request) {
-	debugLog.Printf("Status bar request: %s", r.UserAgent())
+	slog.Debug("Status bar request", "user_agent", r.UserAgent())
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var primaryResp *http.Response
-	var primaryErr error
-
-	// Find primary backend
-	var primaryBackend Backend
-	for _, b := range config.Backends {
-		if b.IsPrimary {
-			primaryBackend = b
-			break
+	// Ask backends one at a time in priority order since this is a GET request
+	for _, b := range currentConfig().responders() {
+		s := stateFor(b)
+		if s.isDisabled() {
+			continue
+		}
+		if state, _ := s.breaker.State(); state == breakerOpen {
+			slog.Debug("Skipping backend for status bar, circuit breaker open", "backend", b.Name)
+			continue
 		}
-	}
-
-	// Forward to primary backend only since this is a GET request
-	req, err := http.NewRequest("GET", primaryBackend.URL+"/api/v1/users/current/statusbar/today", nil)
-	if err != nil {
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
-		return
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(primaryBackend.APIKey))))
-	req.Header.Set("User-Agent", r.UserAgent()+" (JasonLovesDoggo/multitime)")
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	primaryResp, primaryErr = client.Do(req)
+		start := time.Now()
+		resp, err := fetchStatusBar(r.Context(), r.UserAgent(), b)
+		upstreamDuration.observe(time.Since(start).Seconds(), b.Name, "statusbar")
+		result := forwardResult{resp: resp, err: err, backend: b}
+		if !result.usable() {
+			if err != nil {
+				slog.Warn("Status bar request failed", "backend", b.Name, "error", err)
+			} else {
+				slog.Warn("Status bar request failed", "backend", b.Name, "status", resp.StatusCode)
+				resp.Body.Close()
+			}
+			continue
+		}
 
-	if primaryErr != nil {
-		debugLog.Printf("Primary backend error: %v", primaryErr)
-		// Return empty response as specified in the API docs
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"data":{"grand_total":{"decimal":"","digital":"","hours":0,"minutes":0,"text":"","total_seconds":0},"categories":[],"dependencies":[],"editors":[],"languages":[],"machines":[],"operating_systems":[],"projects":[],"range":{"text":"Today","timezone":"UTC"}}}`)
+		slog.Debug("Status bar response", "backend", b.Name, "status", resp.StatusCode)
+		relayResponse(w, result)
 		return
-	} else {
-		debugLog.Printf("Primary response: %s", primaryResp.Status)
 	}
 
-	defer primaryResp.Body.Close()
+	// Return empty response as specified in the API docs
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, emptyStatusBar)
+}
 
-	// Copy headers from primary response
-	for key, values := range primaryResp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
+func handleHeartbeatsBulk(w http.ResponseWriter, r *http.Request) {
+	handleForward(w, r, true)
+}
 
-	// Copy status code and body
-	w.WriteHeader(primaryResp.StatusCode)
-	if _, err := io.Copy(w, primaryResp.Body); err != nil {
-		debugLog.Printf("Error copying response body: %v", err)
-	}
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	handleForward(w, r, false)
 }
 
-func handleHeartbeatsBulk(w http.ResponseWriter, r *http.Request) {
+// handleForward sends a heartbeat (or bulk array of heartbeats) to every
+// backend and relays the response of the first healthy backend in priority
+// order as soon as it is known. Backends that answer later are left to finish
+// in the background.
+func handleForward(w http.ResponseWriter, r *http.Request, bulk bool) {
+	start := time.Now()
+	logger := requestLogger(w, r)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	count := 0
+	defer func() {
+		logger.Info("Handled heartbeats", "path", r.URL.Path, "status", rec.status,
+			"latency", time.Since(start), "heartbeats", count)
+	}()
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	heartbeats, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Error reading request", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
 
-	// Validate JSON
-	if !json.Valid(heartbeats) {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	logger.Debug("Received heartbeats", "bulk", bulk, "body", string(body))
+
+	// Validate heartbeats
+	heartbeats, rejected, err := parseHeartbeats(body, bulk, time.Now())
+	heartbeatsReceived.add(float64(len(heartbeats)+len(rejected)), endpointName(bulk))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorBody(err.Error()))
+		return
+	}
+	if len(heartbeats) == 0 {
+		logger.Debug("No valid heartbeats to forward", "rejected", len(rejected))
+		if !bulk {
+			writeJSON(w, http.StatusBadRequest, rejected[0].errorBody())
+			return
+		}
+		status := http.StatusAccepted
+		if len(rejected) > 0 {
+			status = http.StatusBadRequest
+		}
+		payload, _ := json.Marshal(bulkResponse{Responses: insertRejected([]bulkItem{}, rejected)})
+		writeJSON(w, status, payload)
+		return
+	}
+	count = len(heartbeats)
+
+	// Use one config snapshot for the whole request, even if it is reloaded
+	// meanwhile.
+	cfg := currentConfig()
+	cfg.Enrich.enrich(heartbeats)
+	machine := cfg.Enrich.machineName(r.Header.Get(machineHeader))
+
+	deliveries := planDeliveries(cfg, heartbeats)
+	tail.record(heartbeats, deliveries)
+	if cfg.AckMode == ackModeLocal {
+		acknowledgeLocally(w, r, logger, deliveries, bulk, machine, heartbeats, rejected)
 		return
 	}
 
-	debugLog.Printf("Received bulk heartbeats: %s", string(heartbeats))
-
-	var wg sync.WaitGroup
-	var primaryResp *http.Response
-	var primaryErr error
-	respChan := make(chan struct {
-		resp    *http.Response
-		err     error
-		backend Backend
-	}, len(config.Backends))
+	userAgent := r.UserAgent()
+	respChan := make(chan forwardResult, len(deliveries))
 
 	// Forward to all backends concurrently
-	for _, backend := range config.Backends {
-		wg.Add(1)
-		go func(b Backend) {
-			defer wg.Done()
-			resp, err := forwardHeartbeats(heartbeats, r.UserAgent(), b)
-			respChan <- struct {
-				resp    *http.Response
-				err     error
-				backend Backend
-			}{resp, err, b}
-		}(backend)
-	}
-
-	// Close channel when all goroutines complete
-	go func() {
-		wg.Wait()
-		close(respChan)
-	}()
+	for _, d := range deliveries {
+		go func(d delivery) {
+			b := d.backend
+			if d.skipped != nil {
+				logger.Debug("Not forwarding", "backend", b.Name, "reason", d.skipped)
+				respChan <- forwardResult{err: d.skipped, backend: b}
+				return
+			}
+			body, err := encodeHeartbeats(d.heartbeats, bulk)
+			if err != nil {
+				respChan <- forwardResult{err: err, backend: b}
+				return
+			}
+
+			s := stateFor(b)
+			e := Entry{Bulk: bulk, UserAgent: userAgent, MachineName: machine, Body: body}
+			if s.isPaused() {
+				if err := s.enqueue(e); err == nil {
+					logger.Debug("Queued heartbeats for paused backend", "backend", b.Name)
+					respChan <- forwardResult{err: errPaused, backend: b, indices: d.indices}
+					return
+				}
+			}
+			if !bulk && b.Batch.enabled() {
+				if err := s.enqueue(e); err == nil {
+					logger.Debug("Queued heartbeat for batch", "backend", b.Name)
+					respChan <- forwardResult{err: errBatched, backend: b, indices: d.indices}
+					return
+				}
+			}
+			began := time.Now()
+			resp, err := s.forward(e)
+			logForward(logger, b, len(d.heartbeats), resp, err, began)
+			respChan <- forwardResult{resp: resp, err: err, backend: b, indices: d.indices}
+		}(d)
+	}
+
+	// Collect responses until the one to relay is known
+	order := cfg.responders()
+	results := make(map[string]forwardResult, len(deliveries))
+	for len(results) < len(deliveries) && !responseReady(order, deliveries, results, bulk) {
+		result := <-respChan
+		results[result.backend.Name] = result
+	}
+	if pending := len(deliveries) - len(results); pending > 0 {
+		detached.Add(1)
+		go func() {
+			defer detached.Done()
+			for range pending {
+				if result := <-respChan; result.resp != nil {
+					result.resp.Body.Close()
+				}
+			}
+		}()
+	}
 
-	// Collect responses
-	for result := range respChan {
-		if result.backend.IsPrimary {
-			primaryResp = result.resp
-			primaryErr = result.err
-		} else if result.resp != nil {
+	chosen, ok := chooseResponse(order, results)
+	if ok && bulk {
+		mergeBulkResults(heartbeats, chosen, order, results, rejected)
+	}
+	for _, result := range results {
+		if result.resp != nil && (!ok || result.backend.Name != chosen.backend.Name) {
 			result.resp.Body.Close()
 		}
 	}
 
-	// Handle primary response
-	if primaryErr != nil {
-		debugLog.Printf("Primary backend error: %v", primaryErr)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if !ok {
+		// Heartbeats queued for a batch, already sent or not meant for any
+		// backend are taken care of, so answer the way WakaTime would.
+		for _, result := range results {
+			if handledLocally(result.err) {
+				status, payload, _ := localResponse(heartbeats, rejected, bulk)
+				writeJSON(w, status, payload)
+				return
+			}
+		}
+		http.Error(w, "No backend available", http.StatusBadGateway)
 		return
 	}
 
-	if primaryResp == nil {
-		http.Error(w, "No response from primary backend", http.StatusInternalServerError)
-		return
-	}
+	relayResponse(w, chosen)
+}
 
-	defer primaryResp.Body.Close()
+// delivery is the part of a request that is sent to one backend.
+type delivery struct {
+	backend    Backend
+	heartbeats []Heartbeat
+	// indices maps each heartbeat to its position among the valid heartbeats
+	// of the request.
+	indices []int
+	// skipped explains why nothing is sent to the backend.
+	skipped error
+}
 
-	// Copy headers from primary response
-	for key, values := range primaryResp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+// planDeliveries works out which heartbeats each backend should receive:
+// those its rules accept, rewritten and redacted for it, leaving out the ones
+// it was already sent.
+func planDeliveries(cfg *Config, heartbeats []Heartbeat) []delivery {
+	deliveries := make([]delivery, 0, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		s := stateFor(b)
+		if s.isDisabled() {
+			deliveries = append(deliveries, delivery{backend: b, skipped: errDisabled})
+			continue
+		}
+		var routed []Heartbeat
+		var positions []int
+		for i, h := range heartbeats {
+			if prepared, ok := s.prepare(h); ok {
+				routed = append(routed, prepared)
+				positions = append(positions, i)
+			}
 		}
-	}
-
-	// Copy status code
-	w.WriteHeader(primaryResp.StatusCode)
 
-	// Copy body
-	if _, err := io.Copy(w, primaryResp.Body); err != nil {
-		debugLog.Printf("Error copying response body: %v", err)
+		d := delivery{backend: b}
+		if len(routed) == 0 {
+			d.skipped = errNotRouted
+			deliveries = append(deliveries, d)
+			continue
+		}
+		for i, fresh := range s.admit(routed) {
+			if fresh {
+				d.heartbeats = append(d.heartbeats, routed[i])
+				d.indices = append(d.indices, positions[i])
+			}
+		}
+		if len(d.heartbeats) == 0 {
+			d.skipped = errDuplicate
+		}
+		deliveries = append(deliveries, d)
 	}
+	return deliveries
 }
 
-func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// handledLocally reports whether a backend was not sent the request for a
+// reason that still lets multitime answer the client itself.
+func handledLocally(err error) bool {
+	return err == errBatched || err == errDuplicate || err == errNotRouted || err == errPaused
+}
 
-	heartbeat, err := io.ReadAll(r.Body)
+// acknowledgeLocally queues the heartbeats for every backend and answers the
+// client straight away with a WakaTime-shaped response, leaving delivery to
+// the drainers.
+func acknowledgeLocally(w http.ResponseWriter, r *http.Request, logger *slog.Logger, deliveries []delivery, bulk bool, machine string, heartbeats []Heartbeat, rejected map[int]validationErrors) {
+	status, payload, err := localResponse(heartbeats, rejected, bulk)
 	if err != nil {
-		http.Error(w, "Error reading request", http.StatusBadRequest)
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
 		return
 	}
-	defer r.Body.Close()
 
-	// Validate JSON
-	if !json.Valid(heartbeat) {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	for _, d := range deliveries {
+		if d.skipped != nil {
+			continue
+		}
+		body, err := encodeHeartbeats(d.heartbeats, bulk)
+		if err != nil {
+			logger.Error("Could not encode heartbeats", "backend", d.backend.Name, "error", err)
+			continue
+		}
+
+		s := stateFor(d.backend)
+		e := Entry{Bulk: bulk, UserAgent: r.UserAgent(), MachineName: machine, Body: body}
+		if err := s.enqueue(e); err != nil {
+			logger.Warn("Could not queue heartbeats, forwarding in the background", "backend", d.backend.Name, "error", err)
+			detached.Add(1)
+			go func() {
+				defer detached.Done()
+				began := time.Now()
+				resp, err := s.forward(e)
+				logForward(logger, d.backend, len(d.heartbeats), resp, err, began)
+				if err == nil {
+					resp.Body.Close()
+				}
+			}()
+			continue
+		}
+		logger.Debug("Queued heartbeats", "backend", d.backend.Name, "heartbeats", len(d.heartbeats))
 	}
 
-	debugLog.Printf("Received heartbeat: %s", string(heartbeat))
+	writeJSON(w, status, payload)
+}
 
-	var wg sync.WaitGroup
-	var primaryResp *http.Response
-	var primaryErr error
-	respChan := make(chan struct {
-		resp    *http.Response
-		err     error
-		backend Backend
-	}, len(config.Backends))
+func writeJSON(w http.ResponseWriter, status int, payload []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
 
-	// Forward to all backends concurrently
-	for _, backend := range config.Backends {
-		wg.Add(1)
-		go func(b Backend) {
-			defer wg.Done()
-			resp, err := forwardHeartbeat(heartbeat, r.UserAgent(), b)
-			respChan <- struct {
-				resp    *http.Response
-				err     error
-				backend Backend
-			}{resp, err, b}
-		}(backend)
-	}
-
-	// Close channel when all goroutines complete
-	go func() {
-		wg.Wait()
-		close(respChan)
-	}()
+// localResponse builds the response WakaTime would send for accepted
+// heartbeats: 201 with the heartbeat for a single heartbeat, and 202 with one
+// [body, status] pair per heartbeat for a bulk request.
+func localResponse(heartbeats []Heartbeat, rejected map[int]validationErrors, bulk bool) (int, []byte, error) {
+	type item struct {
+		Data Heartbeat `json:"data"`
+	}
 
-	// Collect responses
-	for result := range respChan {
-		if result.backend.IsPrimary {
-			primaryResp = result.resp
-			primaryErr = result.err
-		} else if result.resp != nil {
-			result.resp.Body.Close()
+	if !bulk {
+		payload, err := json.Marshal(item{Data: heartbeats[0]})
+		return http.StatusCreated, payload, err
+	}
+
+	items := make([]bulkItem, len(heartbeats))
+	for i, h := range heartbeats {
+		data, err := json.Marshal(item{Data: h})
+		if err != nil {
+			return 0, nil, err
 		}
+		items[i] = bulkItem{Body: data, Status: http.StatusCreated}
 	}
+	payload, err := json.Marshal(bulkResponse{Responses: insertRejected(items, rejected)})
+	return http.StatusAccepted, payload, err
+}
 
-	// Handle primary response
-	if primaryErr != nil {
-		debugLog.Printf("Primary backend error: %v", primaryErr)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+// responseReady reports whether the response to relay is known: the first
+// usable result in priority order, once every backend ahead of it has
+// answered. A bulk response also needs the results it is merged with.
+func responseReady(order []Backend, deliveries []delivery, results map[string]forwardResult, bulk bool) bool {
+	for _, b := range order {
+		result, ok := results[b.Name]
+		if !ok {
+			return false
+		}
+		if result.usable() {
+			return !bulk || bulkAnswered(deliveries, results)
+		}
 	}
+	return false
+}
 
-	if primaryResp == nil {
-		http.Error(w, "No response from primary backend", http.StatusInternalServerError)
-		return
+// bulkAnswered reports whether every heartbeat of a bulk request has
+// succeeded on a backend that answered, or has an answer from every backend
+// it was sent to, so merging the results would not change anymore.
+func bulkAnswered(deliveries []delivery, results map[string]forwardResult) bool {
+	succeeded := map[int]bool{}
+	waiting := map[int]bool{}
+	for _, d := range deliveries {
+		result, answered := results[d.backend.Name]
+		if !answered {
+			for _, i := range d.indices {
+				waiting[i] = true
+			}
+			continue
+		}
+		if result.err != nil {
+			continue
+		}
+		items, ok := bulkItems(result.resp, len(result.indices))
+		for j, i := range result.indices {
+			if ok && items[j].ok() {
+				succeeded[i] = true
+			}
+		}
 	}
+	for i := range waiting {
+		if !succeeded[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// chooseResponse picks the first usable result in priority order, falling back
+// to the first backend that answered at all.
+func chooseResponse(order []Backend, results map[string]forwardResult) (forwardResult, bool) {
+	for i, b := range order {
+		if result, ok := results[b.Name]; ok && result.usable() {
+			if i > 0 {
+				slog.Info("Failing over", "backend", b.Name)
+			}
+			return result, true
+		}
+	}
+	for _, b := range order {
+		if result, ok := results[b.Name]; ok && result.err == nil {
+			return result, true
+		}
+		if result, ok := results[b.Name]; ok {
+			slog.Debug("Backend unavailable", "backend", b.Name, "error", result.err)
+		}
+	}
+	return forwardResult{}, false
+}
 
-	defer primaryResp.Body.Close()
+// relayResponse copies a backend response to the client and closes it.
+func relayResponse(w http.ResponseWriter, result forwardResult) {
+	resp := result.resp
+	defer resp.Body.Close()
 
-	// Copy headers from primary response
-	for key, values := range primaryResp.Header {
+	// Copy headers from the backend response
+	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	w.Header().Set(backendHeader, result.backend.Name)
 
-	// Copy status code
-	w.WriteHeader(primaryResp.StatusCode)
-
-	// Copy body
-	if _, err := io.Copy(w, primaryResp.Body); err != nil {
-		debugLog.Printf("Error copying response body: %v", err)
+	// Copy status code and body
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Debug("Could not copy response body", "error", err)
 	}
 }
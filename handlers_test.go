@@ -3,17 +3,19 @@ package main
 import (
 	"bytes"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-func setupTestConfig() {
-	config = &Config{
-		Port:  3000,
-		Debug: false,
+func setupTestConfig(t *testing.T) *Config {
+	cfg := &Config{
+		Port:     3000,
+		Debug:    false,
+		QueueDir: t.TempDir(),
 		Backends: []Backend{
 			{
 				Name:      "Primary Backend",
@@ -30,11 +32,22 @@ func setupTestConfig() {
 		},
 	}
 
-	debugLog = log.New(io.Discard, "", 0)
+	setConfig(cfg)
+
+	t.Cleanup(stopBackends)
+	return cfg
+}
+
+// addTestBackend adds a backend to the test config and publishes it, as a
+// reload would. Backends that are not configured are never started.
+func addTestBackend(cfg *Config, b Backend) Backend {
+	cfg.Backends = append(cfg.Backends, b)
+	setConfig(cfg)
+	return cfg.Backends[len(cfg.Backends)-1]
 }
 
 func TestHandleStatusBar(t *testing.T) {
-	setupTestConfig()
+	cfg := setupTestConfig(t)
 
 	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/v1/users/current/statusbar/today" {
@@ -57,9 +70,9 @@ func TestHandleStatusBar(t *testing.T) {
 	defer primaryServer.Close()
 
 	// Update primary backend URL to point to our test server
-	for i := range config.Backends {
-		if config.Backends[i].IsPrimary {
-			config.Backends[i].URL = primaryServer.URL
+	for i := range cfg.Backends {
+		if cfg.Backends[i].IsPrimary {
+			cfg.Backends[i].URL = primaryServer.URL
 		}
 	}
 
@@ -91,7 +104,7 @@ func TestHandleStatusBar(t *testing.T) {
 }
 
 func TestHandleHeartbeat(t *testing.T) {
-	setupTestConfig()
+	cfg := setupTestConfig(t)
 
 	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/v1/users/current/heartbeats" {
@@ -108,8 +121,8 @@ func TestHandleHeartbeat(t *testing.T) {
 		}
 		defer r.Body.Close()
 
-		if string(body) != `{"test":"heartbeat"}` {
-			t.Errorf("Expected request body {\"test\":\"heartbeat\"}, got %s", string(body))
+		if string(body) != `{"entity":"main.go","type":"file","time":1700000000}` {
+			t.Errorf("Expected request body {\"entity\":\"main.go\",\"type\":\"file\",\"time\":1700000000}, got %s", string(body))
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -134,8 +147,8 @@ func TestHandleHeartbeat(t *testing.T) {
 		}
 		defer r.Body.Close()
 
-		if string(body) != `{"test":"heartbeat"}` {
-			t.Errorf("Expected request body {\"test\":\"heartbeat\"}, got %s", string(body))
+		if string(body) != `{"entity":"main.go","type":"file","time":1700000000}` {
+			t.Errorf("Expected request body {\"entity\":\"main.go\",\"type\":\"file\",\"time\":1700000000}, got %s", string(body))
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -144,15 +157,15 @@ func TestHandleHeartbeat(t *testing.T) {
 	}))
 	defer secondaryServer.Close()
 
-	for i := range config.Backends {
-		if config.Backends[i].IsPrimary {
-			config.Backends[i].URL = primaryServer.URL
+	for i := range cfg.Backends {
+		if cfg.Backends[i].IsPrimary {
+			cfg.Backends[i].URL = primaryServer.URL
 		} else {
-			config.Backends[i].URL = secondaryServer.URL
+			cfg.Backends[i].URL = secondaryServer.URL
 		}
 	}
 
-	heartbeat := []byte(`{"test":"heartbeat"}`)
+	heartbeat := []byte(`{"entity":"main.go","type":"file","time":1700000000}`)
 	req, err := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader(heartbeat))
 	if err != nil {
 		t.Fatalf("Failed to create request: %v", err)
@@ -191,7 +204,7 @@ func TestHandleHeartbeat(t *testing.T) {
 
 func TestHandleHeartbeatsBulk(t *testing.T) {
 
-	setupTestConfig()
+	cfg := setupTestConfig(t)
 
 	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -209,8 +222,8 @@ func TestHandleHeartbeatsBulk(t *testing.T) {
 		}
 		defer r.Body.Close()
 
-		if string(body) != `[{"test":"heartbeat1"},{"test":"heartbeat2"}]` {
-			t.Errorf("Expected request body [{\"test\":\"heartbeat1\"},{\"test\":\"heartbeat2\"}], got %s", string(body))
+		if string(body) != `[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]` {
+			t.Errorf("Expected request body [{\"entity\":\"a.go\",\"type\":\"file\",\"time\":1700000000},{\"entity\":\"b.go\",\"type\":\"file\",\"time\":1700000000}], got %s", string(body))
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -235,8 +248,8 @@ func TestHandleHeartbeatsBulk(t *testing.T) {
 		}
 		defer r.Body.Close()
 
-		if string(body) != `[{"test":"heartbeat1"},{"test":"heartbeat2"}]` {
-			t.Errorf("Expected request body [{\"test\":\"heartbeat1\"},{\"test\":\"heartbeat2\"}], got %s", string(body))
+		if string(body) != `[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]` {
+			t.Errorf("Expected request body [{\"entity\":\"a.go\",\"type\":\"file\",\"time\":1700000000},{\"entity\":\"b.go\",\"type\":\"file\",\"time\":1700000000}], got %s", string(body))
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -245,15 +258,15 @@ func TestHandleHeartbeatsBulk(t *testing.T) {
 	}))
 	defer secondaryServer.Close()
 
-	for i := range config.Backends {
-		if config.Backends[i].IsPrimary {
-			config.Backends[i].URL = primaryServer.URL
+	for i := range cfg.Backends {
+		if cfg.Backends[i].IsPrimary {
+			cfg.Backends[i].URL = primaryServer.URL
 		} else {
-			config.Backends[i].URL = secondaryServer.URL
+			cfg.Backends[i].URL = secondaryServer.URL
 		}
 	}
 
-	heartbeats := []byte(`[{"test":"heartbeat1"},{"test":"heartbeat2"}]`)
+	heartbeats := []byte(`[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]`)
 	req, err := http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader(heartbeats))
 	if err != nil {
 		t.Fatalf("Failed to create request: %v", err)
@@ -288,3 +301,164 @@ func TestHandleHeartbeatsBulk(t *testing.T) {
 		t.Errorf("Handler should return 400 for invalid JSON, got %v", status)
 	}
 }
+
+func TestHandleHeartbeatFailover(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primaryServer.Close()
+
+	secondaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "statusbar") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"data":"secondary status bar"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"data":"secondary success"}`))
+	}))
+	defer secondaryServer.Close()
+
+	for i := range cfg.Backends {
+		cfg.Backends[i].Retry = RetryPolicy{MaxAttempts: 1}
+		if cfg.Backends[i].IsPrimary {
+			cfg.Backends[i].URL = primaryServer.URL
+		} else {
+			cfg.Backends[i].URL = secondaryServer.URL
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"main.go","type":"file","time":1700000000}`)))
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr.Body.String() != `{"data":"secondary success"}` {
+		t.Errorf("Handler returned unexpected body: %s", rr.Body.String())
+	}
+	if got := rr.Header().Get(backendHeader); got != "Secondary Backend" {
+		t.Errorf("Expected %s header to name the secondary backend, got %q", backendHeader, got)
+	}
+
+	req, _ = http.NewRequest("GET", "/users/current/statusbar/today", nil)
+	rr = httptest.NewRecorder()
+	handleStatusBar(rr, req)
+
+	if rr.Body.String() != `{"data":"secondary status bar"}` {
+		t.Errorf("Status bar should be served by the secondary backend, got %s", rr.Body.String())
+	}
+	if got := rr.Header().Get(backendHeader); got != "Secondary Backend" {
+		t.Errorf("Expected %s header to name the secondary backend, got %q", backendHeader, got)
+	}
+
+	// With the priority list reversed the secondary answers first.
+	cfg.Priority = []string{"Secondary Backend", "Primary Backend"}
+	order := cfg.responders()
+	if len(order) != 2 || order[0].Name != "Secondary Backend" {
+		t.Errorf("Unexpected responder order: %+v", order)
+	}
+}
+
+func TestHandleHeartbeatDoesNotWaitForOtherBackends(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	primaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer primaryServer.Close()
+	release := make(chan struct{})
+	secondaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer secondaryServer.Close()
+	cfg.Backends[0].URL = primaryServer.URL
+	cfg.Backends[1].URL = secondaryServer.URL
+
+	handled := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"main.go","type":"file","time":1700000000}`)))
+		rr := httptest.NewRecorder()
+		handleHeartbeat(rr, req)
+		handled <- rr.Code
+	}()
+	select {
+	case code := <-handled:
+		if code != http.StatusCreated {
+			t.Errorf("Expected the primary's 201, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the primary's response without waiting for the secondary")
+	}
+
+	// The secondary's 429 is left in the outbox for the drainer, rather than
+	// retried after Retry-After while the editor waits.
+	start := time.Now()
+	close(release)
+	detached.Wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected a single attempt in the request path, took %v", elapsed)
+	}
+	if n := stateFor(cfg.Backends[1]).outbox.Len(); n != 1 {
+		t.Errorf("Expected the heartbeat to stay queued for the secondary, got %d entries", n)
+	}
+}
+
+func TestHandleHeartbeatLocalAck(t *testing.T) {
+	cfg := setupTestConfig(t)
+	cfg.AckMode = ackModeLocal
+
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	for i := range cfg.Backends {
+		cfg.Backends[i].URL = server.URL
+	}
+
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"main.go","type":"file","time":1700000000}`)))
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if expected := `{"data":{"entity":"main.go","type":"file","time":1700000000}}`; rr.Body.String() != expected {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	req, _ = http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader([]byte(`[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]`)))
+	rr = httptest.NewRecorder()
+	handleHeartbeatsBulk(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	if expected := `{"responses":[[{"data":{"entity":"a.go","type":"file","time":1700000000}},201],[{"data":{"entity":"b.go","type":"file","time":1700000000}},201]]}`; rr.Body.String() != expected {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// Both requests are delivered to both backends in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for received.Load() < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received.Load() != 4 {
+		t.Errorf("Expected 4 upstream requests, got %d", received.Load())
+	}
+
+	req, _ = http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader([]byte(`{"entity":"a.go","type":"file","time":1700000000}`)))
+	rr = httptest.NewRecorder()
+	handleHeartbeatsBulk(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler should return 400 for a non-array bulk body, got %v", rr.Code)
+	}
+}
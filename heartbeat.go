@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Heartbeat is a single WakaTime heartbeat. Fields multitime does not know
+// about are kept in Extra and forwarded untouched.
+type Heartbeat struct {
+	Entity           string   `json:"entity"`
+	Type             string   `json:"type"`
+	Category         string   `json:"category,omitempty"`
+	Time             float64  `json:"time"`
+	Project          string   `json:"project,omitempty"`
+	ProjectRootCount *int     `json:"project_root_count,omitempty"`
+	Branch           string   `json:"branch,omitempty"`
+	Language         string   `json:"language,omitempty"`
+	Dependencies     []string `json:"dependencies,omitempty"`
+	Lines            *int     `json:"lines,omitempty"`
+	LineNo           *int     `json:"lineno,omitempty"`
+	CursorPos        *int     `json:"cursorpos,omitempty"`
+	LineAdditions    *int     `json:"line_additions,omitempty"`
+	LineDeletions    *int     `json:"line_deletions,omitempty"`
+	AILineChanges    *int     `json:"ai_line_changes,omitempty"`
+	HumanLineChanges *int     `json:"human_line_changes,omitempty"`
+	IsWrite          bool     `json:"is_write,omitempty"`
+	UserAgent        string   `json:"user_agent,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// heartbeatFields is Heartbeat without its custom JSON methods.
+type heartbeatFields Heartbeat
+
+func (h *Heartbeat) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*heartbeatFields)(h)); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, key := range knownHeartbeatKeys {
+		delete(all, key)
+	}
+	h.Extra = nil
+	if len(all) > 0 {
+		h.Extra = all
+	}
+	return nil
+}
+
+func (h Heartbeat) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(heartbeatFields(h))
+	if err != nil || len(h.Extra) == 0 {
+		return data, err
+	}
+
+	// Append unknown fields after the known ones, in a stable order.
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1])
+	for _, key := range slices.Sorted(maps.Keys(h.Extra)) {
+		name, _ := json.Marshal(key)
+		buf.WriteByte(',')
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(h.Extra[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var knownHeartbeatKeys = []string{
+	"entity", "type", "category", "time", "project", "project_root_count",
+	"branch", "language", "dependencies", "lines", "lineno", "cursorpos",
+	"line_additions", "line_deletions", "ai_line_changes", "human_line_changes",
+	"is_write", "user_agent",
+}
+
+var heartbeatTypes = []string{"file", "app", "domain", "url", "event"}
+
+var heartbeatCategories = []string{
+	"coding", "ai coding", "building", "indexing", "debugging", "browsing",
+	"running tests", "writing tests", "manual testing", "writing docs",
+	"communicating", "code reviewing", "researching", "learning", "designing",
+	"meeting", "planning", "supporting", "translating", "advising",
+}
+
+// earliestHeartbeat is the oldest timestamp accepted; WakaTime did not exist
+// before it.
+var earliestHeartbeat = time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxClockSkew is how far in the future a heartbeat may be timestamped.
+const maxClockSkew = time.Hour
+
+// requestError is a problem with the request body as a whole. Its text is
+// shown to the client.
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+const (
+	errInvalidJSON requestError = "Invalid JSON"
+	errNotObject   requestError = "Expected a heartbeat object"
+	errNotArray    requestError = "Expected a JSON array of heartbeats"
+)
+
+// validationErrors maps a field name to what is wrong with it, mirroring the
+// "errors" object of a WakaTime 400 response.
+type validationErrors map[string][]string
+
+func (v validationErrors) add(field, msg string) {
+	v[field] = append(v[field], msg)
+}
+
+// Validate checks required fields, enum values and ranges.
+func (h *Heartbeat) Validate(now time.Time) validationErrors {
+	errs := validationErrors{}
+
+	if h.Entity == "" {
+		errs.add("entity", "This field is required.")
+	}
+	if h.Type == "" {
+		errs.add("type", "This field is required.")
+	} else if !slices.Contains(heartbeatTypes, h.Type) {
+		errs.add("type", fmt.Sprintf("Invalid type %q.", h.Type))
+	}
+	if h.Category != "" && !slices.Contains(heartbeatCategories, h.Category) {
+		errs.add("category", fmt.Sprintf("Invalid category %q.", h.Category))
+	}
+
+	switch {
+	case h.Time == 0:
+		errs.add("time", "This field is required.")
+	case h.Time < float64(earliestHeartbeat.Unix()):
+		errs.add("time", "Time is too far in the past.")
+	case h.Time > float64(now.Add(maxClockSkew).Unix()):
+		errs.add("time", "Time is in the future.")
+	}
+
+	for field, value := range map[string]*int{
+		"project_root_count": h.ProjectRootCount,
+		"lines":              h.Lines,
+		"lineno":             h.LineNo,
+		"cursorpos":          h.CursorPos,
+		"line_additions":     h.LineAdditions,
+		"line_deletions":     h.LineDeletions,
+	} {
+		if value != nil && *value < 0 {
+			errs.add(field, "Must not be negative.")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// errorBody renders validation errors the way WakaTime does.
+func (v validationErrors) errorBody() json.RawMessage {
+	data, _ := json.Marshal(map[string]validationErrors{"errors": v})
+	return data
+}
+
+// errorBody renders a single error message the way WakaTime does.
+func errorBody(msg string) []byte {
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	return data
+}
+
+// parseHeartbeats decodes and validates a request body. For bulk requests,
+// heartbeats that fail validation are returned in rejected keyed by their
+// index in the request instead of failing the whole request.
+func parseHeartbeats(body []byte, bulk bool, now time.Time) (valid []Heartbeat, rejected map[int]validationErrors, err error) {
+	if !bulk {
+		var h Heartbeat
+		if err := json.Unmarshal(body, &h); err != nil {
+			if json.Valid(body) {
+				return nil, nil, errNotObject
+			}
+			return nil, nil, errInvalidJSON
+		}
+		if errs := h.Validate(now); errs != nil {
+			return nil, map[int]validationErrors{0: errs}, nil
+		}
+		return []Heartbeat{h}, nil, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		if json.Valid(body) {
+			return nil, nil, errNotArray
+		}
+		return nil, nil, errInvalidJSON
+	}
+
+	rejected = map[int]validationErrors{}
+	for i, item := range items {
+		var h Heartbeat
+		if err := json.Unmarshal(item, &h); err != nil {
+			rejected[i] = validationErrors{"heartbeat": {"Expected a heartbeat object."}}
+			continue
+		}
+		if errs := h.Validate(now); errs != nil {
+			rejected[i] = errs
+			continue
+		}
+		valid = append(valid, h)
+	}
+	return valid, rejected, nil
+}
+
+// encodeHeartbeats renders heartbeats as a request body for one of the
+// heartbeat endpoints.
+func encodeHeartbeats(heartbeats []Heartbeat, bulk bool) ([]byte, error) {
+	if bulk {
+		return json.Marshal(heartbeats)
+	}
+	return json.Marshal(heartbeats[0])
+}
+
+// entryHeartbeats decodes the heartbeats of a queued entry.
+func entryHeartbeats(e Entry) ([]Heartbeat, error) {
+	if !e.Bulk {
+		var h Heartbeat
+		err := json.Unmarshal(e.Body, &h)
+		return []Heartbeat{h}, err
+	}
+	var heartbeats []Heartbeat
+	err := json.Unmarshal(e.Body, &heartbeats)
+	return heartbeats, err
+}
+
+// insertRejected adds a 400 result for every rejected heartbeat to a bulk
+// response covering only the valid ones, so the client gets one result per
+// heartbeat it sent.
+func insertRejected(items []bulkItem, rejected map[int]validationErrors) []bulkItem {
+	if len(rejected) == 0 {
+		return items
+	}
+	all := make([]bulkItem, 0, len(items)+len(rejected))
+	for i := 0; len(items) > 0 || rejected[i] != nil; i++ {
+		if errs, ok := rejected[i]; ok {
+			all = append(all, bulkItem{Body: errs.errorBody(), Status: 400})
+			continue
+		}
+		all = append(all, items[0])
+		items = items[1:]
+	}
+	return all
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRoundTrip(t *testing.T) {
+	data := `{"entity":"main.go","type":"file","category":"coding","time":1700000000.5,"project":"multitime","lineno":3,"is_write":true,"editor_specific":{"x":1},"plugin":"vim"}`
+
+	var h Heartbeat
+	if err := json.Unmarshal([]byte(data), &h); err != nil {
+		t.Fatalf("Failed to decode heartbeat: %v", err)
+	}
+	if h.Entity != "main.go" || h.Project != "multitime" || *h.LineNo != 3 || !h.IsWrite {
+		t.Errorf("Unexpected heartbeat: %+v", h)
+	}
+	if len(h.Extra) != 2 {
+		t.Errorf("Expected 2 unknown fields to be kept, got %v", h.Extra)
+	}
+
+	out, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("Failed to encode heartbeat: %v", err)
+	}
+	if string(out) != data {
+		t.Errorf("Expected %s, got %s", data, out)
+	}
+}
+
+func TestHeartbeatValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	negative := -1
+
+	tests := []struct {
+		name      string
+		heartbeat Heartbeat
+		fields    []string
+	}{
+		{"Valid", Heartbeat{Entity: "main.go", Type: "file", Category: "coding", Time: 1700000000}, nil},
+		{"Missing required fields", Heartbeat{}, []string{"entity", "type", "time"}},
+		{"Unknown type", Heartbeat{Entity: "main.go", Type: "folder", Time: 1700000000}, []string{"type"}},
+		{"Unknown category", Heartbeat{Entity: "main.go", Type: "file", Category: "napping", Time: 1700000000}, []string{"category"}},
+		{"Ancient time", Heartbeat{Entity: "main.go", Type: "file", Time: 1000}, []string{"time"}},
+		{"Future time", Heartbeat{Entity: "main.go", Type: "file", Time: 1700000000 + 2*3600}, []string{"time"}},
+		{"Negative line number", Heartbeat{Entity: "main.go", Type: "file", Time: 1700000000, LineNo: &negative}, []string{"lineno"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := tc.heartbeat.Validate(now)
+			if len(errs) != len(tc.fields) {
+				t.Fatalf("Expected errors for %v, got %v", tc.fields, errs)
+			}
+			for _, field := range tc.fields {
+				if _, ok := errs[field]; !ok {
+					t.Errorf("Expected an error for %s, got %v", field, errs)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHeartbeats(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	if _, _, err := parseHeartbeats([]byte(`42`), false, now); err != errNotObject {
+		t.Errorf("Expected errNotObject, got %v", err)
+	}
+	if _, _, err := parseHeartbeats([]byte(`{"entity":"a.go"}`), true, now); err != errNotArray {
+		t.Errorf("Expected errNotArray, got %v", err)
+	}
+	if _, _, err := parseHeartbeats([]byte(`[{`), true, now); err != errInvalidJSON {
+		t.Errorf("Expected errInvalidJSON, got %v", err)
+	}
+
+	valid, rejected, err := parseHeartbeats([]byte(`[{"entity":"a.go","type":"file","time":1700000000},42,{"entity":"c.go"}]`), true, now)
+	if err != nil {
+		t.Fatalf("parseHeartbeats returned error: %v", err)
+	}
+	if len(valid) != 1 || valid[0].Entity != "a.go" {
+		t.Errorf("Expected only a.go to be valid, got %+v", valid)
+	}
+	if len(rejected) != 2 || rejected[1] == nil || rejected[2] == nil {
+		t.Errorf("Expected heartbeats 1 and 2 to be rejected, got %v", rejected)
+	}
+
+	items := insertRejected([]bulkItem{{Body: json.RawMessage(`{}`), Status: 201}}, rejected)
+	if len(items) != 3 || items[0].Status != 201 || items[1].Status != 400 || items[2].Status != 400 {
+		t.Errorf("Unexpected merged results: %+v", items)
+	}
+}
+
+func TestHandleHeartbeatsBulkRejectsInvalidItems(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var forwarded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded = body
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"responses":[[{"data":{"id":"1"}},201]]}`))
+	}))
+	defer server.Close()
+	cfg.Backends = cfg.Backends[:1]
+	cfg.Backends[0].URL = server.URL
+
+	body := `[{"entity":"bad.go"},{"entity":"a.go","type":"file","time":1700000000}]`
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	handleHeartbeatsBulk(rr, req)
+
+	if string(forwarded) != `[{"entity":"a.go","type":"file","time":1700000000}]` {
+		t.Errorf("Expected only the valid heartbeat to be forwarded, got %s", forwarded)
+	}
+	expected := `{"responses":[[{"errors":{"time":["This field is required."],"type":["This field is required."]}},400],[{"data":{"id":"1"}},201]]}`
+	if rr.Body.String() != expected {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	req, _ = http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"a.go","type":"folder","time":1700000000}`)))
+	rr = httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+	if rr.Code != http.StatusBadRequest || rr.Body.String() != `{"errors":{"type":["Invalid type \"folder\"."]}}` {
+		t.Errorf("Expected a WakaTime-style 400, got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Log output formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Log file rotation defaults.
+const (
+	defaultLogMaxSizeMB  = 10
+	defaultLogMaxBackups = 5
+)
+
+// requestIDHeader carries the id that ties together the log lines of one
+// request. A client or proxy may set it; otherwise one is generated.
+const requestIDHeader = "X-Request-Id"
+
+// logLevel is shared by every handler so the level can change on reload.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel accepts debug, info, warn and error.
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("log_level must be debug, info, warn or error, got %q", level)
+	}
+	return l, nil
+}
+
+// level returns the configured log level. The older debug option still
+// turns on debug logging when no log_level is set.
+func (c *Config) level() slog.Level {
+	if c.LogLevel == "" {
+		if c.Debug {
+			return slog.LevelDebug
+		}
+		return slog.LevelInfo
+	}
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// setupLogging sends log output to stderr or the log file in the configured
+// format, with API keys redacted from every line.
+func setupLogging(cfg *Config) error {
+	var w io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSizeMB)<<20, cfg.LogMaxBackups)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	w = redactingWriter{w}
+
+	logLevel.Set(cfg.level())
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if cfg.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// requestLogger returns a logger whose lines carry the request's id, and
+// echoes the id back to the client.
+func requestLogger(w http.ResponseWriter, r *http.Request) *slog.Logger {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return slog.With("request_id", id)
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// logForward records the outcome of sending heartbeats to one backend.
+// Failures are logged as warnings so they show up without debug logging.
+func logForward(logger *slog.Logger, b Backend, heartbeats int, resp *http.Response, err error, began time.Time) {
+	attrs := []any{"backend", b.Name, "heartbeats", heartbeats, "latency", time.Since(began)}
+	switch {
+	case err != nil:
+		logger.Warn("Forwarding failed", append(attrs, "error", err)...)
+	case resp.StatusCode >= http.StatusBadRequest:
+		logger.Warn("Forwarding failed", append(attrs, "status", resp.StatusCode)...)
+	default:
+		logger.Debug("Forwarded heartbeats", append(attrs, "status", resp.StatusCode)...)
+	}
+}
+
+// rotatingFile is a log file that is renamed to path.1 once it reaches
+// maxSize, shifting older files up and deleting those beyond maxBackups.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+func (r *rotatingFile) rotate() error {
+	var errs []error
+	if err := r.file.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for n := r.maxBackups; n >= 1; n-- {
+		from := r.path
+		if n > 1 {
+			from = r.backup(n - 1)
+		}
+		if err := os.Rename(from, r.backup(n)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	// Keep logging even if a backup could not be moved, but say so where
+	// someone might notice.
+	if err := r.open(); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Log rotation failed: %v\n", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "multitime.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Failed to write %q: %v", line, err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("Expected %s to contain %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only two backups to be kept, got %v", err)
+	}
+}
+
+func TestConfigLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want slog.Level
+	}{
+		{"Default", Config{}, slog.LevelInfo},
+		{"Debug option", Config{Debug: true}, slog.LevelDebug},
+		{"Level wins over debug", Config{Debug: true, LogLevel: "warn"}, slog.LevelWarn},
+		{"Upper case", Config{LogLevel: "ERROR"}, slog.LevelError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cfg.level(); got != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+}
+
+func TestHandleHeartbeatLogsRequest(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var buf bytes.Buffer
+	original := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(original)
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer failing.Close()
+	cfg.Backends[0].URL = ok.URL
+	cfg.Backends[1].URL = failing.URL
+
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", strings.NewReader(`{"entity":"main.go","type":"file","time":1700000000}`))
+	req.Header.Set(requestIDHeader, "abc123")
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+	// The secondary may still be answering after the primary's response.
+	detached.Wait()
+
+	if got := rr.Header().Get(requestIDHeader); got != "abc123" {
+		t.Errorf("Expected the request id to be echoed, got %q", got)
+	}
+
+	type record struct {
+		Level      string `json:"level"`
+		Msg        string `json:"msg"`
+		RequestID  string `json:"request_id"`
+		Backend    string `json:"backend"`
+		Status     int    `json:"status"`
+		Heartbeats int    `json:"heartbeats"`
+		Latency    int64  `json:"latency"`
+	}
+	found := map[string]record{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			t.Fatalf("Failed to parse log line %s: %v", line, err)
+		}
+		if rec.RequestID == "abc123" && rec.Msg != "Received heartbeats" {
+			found[rec.Msg+"/"+rec.Backend] = rec
+		}
+	}
+
+	expected := map[string]record{
+		"Forwarded heartbeats/Primary Backend": {Level: "DEBUG", Status: http.StatusCreated, Heartbeats: 1},
+		"Forwarding failed/Secondary Backend":  {Level: "WARN", Status: http.StatusUnauthorized, Heartbeats: 1},
+		"Handled heartbeats/":                  {Level: "INFO", Status: http.StatusCreated, Heartbeats: 1},
+	}
+	for key, want := range expected {
+		got, ok := found[key]
+		if !ok {
+			t.Errorf("Expected a %q log line, got %v", key, found)
+			continue
+		}
+		if got.Level != want.Level || got.Status != want.Status || got.Heartbeats != want.Heartbeats || got.Latency <= 0 {
+			t.Errorf("Unexpected %q log line: %+v", key, got)
+		}
+	}
+}
@@ -1,39 +1,87 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-)
-
-var (
-	debugLog *log.Logger
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := runValidate(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "rules" && os.Args[2] == "test" {
+		if err := runRulesTest(os.Args[3:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if len(os.Args) != 2 {
-		log.Fatal("Usage: multitime <config_file>")
+		log.Fatal("Usage: multitime <config_file>\n       multitime validate <config_file>\n       multitime rules test <config_file> [heartbeats_file]")
 	}
 
-	var err error
-	config, err = loadConfig(os.Args[1])
+	cfg, err := loadConfig(os.Args[1])
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
+	setConfig(cfg)
+
+	if err := setupLogging(cfg); err != nil {
+		log.Fatalf("Error opening log file: %v", err)
+	}
+
+	// Open every outbox up front so anything left over from a previous run
+	// starts draining straight away.
+	syncBackends(cfg)
+	stop := make(chan struct{})
+	go watchConfig(os.Args[1], stop)
+	go runProbes(stop)
 
-	setupLogging(config.Debug)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+	servers := []*http.Server{server}
+	if cfg.Admin.enabled() {
+		admin := &http.Server{Addr: cfg.Admin.Listen, Handler: adminHandler()}
+		servers = append(servers, admin)
+		go serveAdmin(admin)
+	}
 
 	http.HandleFunc("/users/current/heartbeats", handleHeartbeat)
 	http.HandleFunc("/users/current/heartbeats.bulk", handleHeartbeatsBulk)
 	http.HandleFunc("/users/current/statusbar/today", handleStatusBar)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// The "/" matches anything not handled elsewhere. If it's not the root
 		// then report not found.
 
-		debugLog.Printf("404 Not Found: %s", r.URL.Path)
+		slog.Debug("Not found", "path", r.URL.Path)
 		http.NotFound(w, r)
 	})
-	log.Printf("Starting MultiTime server on port %d", config.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil))
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go func() {
+		slog.Info("Starting MultiTime server", "port", cfg.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-signals.Done()
+	// A second signal exits straight away.
+	stopSignals()
+	timeout := currentConfig().ShutdownTimeout.Duration
+	slog.Info("Shutting down, waiting for forwards in flight", "timeout", timeout)
+	close(stop)
+	shutdown(servers, timeout)
+	slog.Info("Shut down")
 }
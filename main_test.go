@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -46,12 +47,15 @@ is_primary = false
 	defer func() { os.Args = originalArgs }()
 	os.Args = []string{"multitime", tmpfile.Name()}
 
-	// Save original config and debugLog
-	originalConfig := config
-	originalDebugLog := debugLog
+	// Save original config and loggers
+	originalConfig := currentConfig()
+	originalLogger := slog.Default()
+	originalWriter, originalFlags := log.Writer(), log.Flags()
 	defer func() {
-		config = originalConfig
-		debugLog = originalDebugLog
+		configValue.Store(originalConfig)
+		slog.SetDefault(originalLogger)
+		log.SetOutput(originalWriter)
+		log.SetFlags(originalFlags)
 	}()
 
 	// Create mock servers for backends
@@ -85,22 +89,26 @@ is_primary = false
 	defer secondaryServer.Close()
 
 	// Load config
-	var loadErr error
-	config, loadErr = loadConfig(tmpfile.Name())
+	cfg, loadErr := loadConfig(tmpfile.Name())
 	if loadErr != nil {
 		t.Fatalf("Failed to load config: %v", loadErr)
 	}
+	cfg.QueueDir = t.TempDir()
+	defer stopBackends()
 
 	// Update backend URLs to point to our test servers
-	for i := range config.Backends {
-		if config.Backends[i].IsPrimary {
-			config.Backends[i].URL = primaryServer.URL
+	for i := range cfg.Backends {
+		if cfg.Backends[i].IsPrimary {
+			cfg.Backends[i].URL = primaryServer.URL
 		} else {
-			config.Backends[i].URL = secondaryServer.URL
+			cfg.Backends[i].URL = secondaryServer.URL
 		}
 	}
+	setConfig(cfg)
 
-	setupLogging(config.Debug)
+	if err := setupLogging(cfg); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/users/current/heartbeats", handleHeartbeat)
@@ -134,7 +142,7 @@ is_primary = false
 			name:           "Heartbeat",
 			method:         "POST",
 			path:           "/users/current/heartbeats",
-			body:           `{"test":"heartbeat"}`,
+			body:           `{"entity":"main.go","type":"file","time":1700000000}`,
 			expectedStatus: http.StatusAccepted,
 			expectedBody:   `{"data":"primary heartbeat success"}`,
 		},
@@ -142,7 +150,7 @@ is_primary = false
 			name:           "Heartbeats Bulk",
 			method:         "POST",
 			path:           "/users/current/heartbeats.bulk",
-			body:           `[{"test":"heartbeat1"},{"test":"heartbeat2"}]`,
+			body:           `[{"entity":"a.go","type":"file","time":1700000000},{"entity":"b.go","type":"file","time":1700000000}]`,
 			expectedStatus: http.StatusAccepted,
 			expectedBody:   `{"data":"primary bulk success"}`,
 		},
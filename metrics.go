@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamBuckets are the latency histogram buckets in seconds, up to the
+// 10 second client timeout.
+var upstreamBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	heartbeatsReceived = newMetricVec("multitime_heartbeats_received_total", "counter",
+		"Heartbeats received from clients, including invalid ones.", "endpoint")
+	heartbeatsForwarded = newMetricVec("multitime_heartbeats_forwarded_total", "counter",
+		"Heartbeats a backend accepted.", "backend", "endpoint")
+	heartbeatsFailed = newMetricVec("multitime_heartbeats_failed_total", "counter",
+		"Heartbeats a backend could not be sent or did not accept after retrying. Heartbeats kept in the outbox are counted again when they are replayed.", "backend", "endpoint")
+	upstreamRetries = newMetricVec("multitime_upstream_retries_total", "counter",
+		"Requests to a backend that were retried.", "backend")
+	upstreamDuration = newHistogramVec("multitime_upstream_request_duration_seconds",
+		"Time taken by requests to a backend.", upstreamBuckets, "backend", "endpoint")
+)
+
+// endpointName returns the endpoint label for a heartbeat request.
+func endpointName(bulk bool) string {
+	if bulk {
+		return "heartbeats.bulk"
+	}
+	return "heartbeats"
+}
+
+// metricVec is a counter or histogram with a set of labels. Series are
+// created on first use.
+type metricVec struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only: observations per bucket, not cumulative.
+	counts []uint64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, kind: kind, help: help, labels: labels, series: map[string]*series{}}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetricVec(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+func (m *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add increases a counter.
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+// observe records a histogram observation.
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	s.value += v
+	i, _ := slices.BinarySearch(m.buckets, v)
+	s.counts[i]++
+}
+
+// sum adds up the series whose leading label values match the given ones.
+func (m *metricVec) sum(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total float64
+	for _, s := range m.series {
+		if slices.Equal(s.labelValues[:len(labelValues)], labelValues) {
+			total += s.value
+		}
+	}
+	return total
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+
+		var count uint64
+		for i, upper := range slices.Concat(m.buckets, []float64{math.Inf(1)}) {
+			count += s.counts[i]
+			labels := formatLabels(slices.Concat(m.labels, []string{"le"}), slices.Concat(s.labelValues, []string{formatValue(upper)}))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labels, count)
+		}
+		labels := formatLabels(m.labels, s.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// recordDelivery counts the heartbeats of an entry once sending it is done,
+// using the per-heartbeat results of a bulk response when there are some.
+func recordDelivery(b Backend, e Entry, resp *http.Response, err error) {
+	endpoint := endpointName(e.Bulk)
+	count := 1
+	if e.Bulk {
+		heartbeats, err := splitBulk(e.Body)
+		if err != nil {
+			return
+		}
+		count = len(heartbeats)
+	}
+
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		heartbeatsFailed.add(float64(count), b.Name, endpoint)
+		return
+	}
+	if e.Bulk {
+		if items, ok := bulkItems(resp, count); ok {
+			failed := 0
+			for _, item := range items {
+				if !item.ok() {
+					failed++
+				}
+			}
+			heartbeatsFailed.add(float64(failed), b.Name, endpoint)
+			count -= failed
+		}
+	}
+	heartbeatsForwarded.add(float64(count), b.Name, endpoint)
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var buf strings.Builder
+	for _, m := range []*metricVec{heartbeatsReceived, heartbeatsForwarded, heartbeatsFailed, upstreamRetries, upstreamDuration} {
+		m.write(&buf)
+	}
+	writeBackendGauges(&buf)
+	if _, err := io.WriteString(w, buf.String()); err != nil {
+		slog.Debug("Could not write metrics", "error", err)
+	}
+}
+
+// writeBackendGauges reports the current outbox and circuit breaker state of
+// every configured backend.
+func writeBackendGauges(w io.Writer) {
+	gauges := []struct {
+		name, help string
+		value      func(s *backendState) float64
+	}{
+		{"multitime_outbox_depth", "Requests waiting in the backend's outbox; a bulk request counts once.", func(s *backendState) float64 {
+			if s.outbox == nil {
+				return 0
+			}
+			return float64(s.outbox.Len())
+		}},
+		{"multitime_circuit_breaker_state", "Circuit breaker state: 0 closed, 1 open, 2 half-open.", func(s *backendState) float64 {
+			state, _ := s.breaker.State()
+			return float64(state)
+		}},
+		{"multitime_backend_up", "Whether the backend passed its last probe.", func(s *backendState) float64 {
+			if s.lastProbe().ok() {
+				return 1
+			}
+			return 0
+		}},
+		{"multitime_backend_consecutive_failures", "Requests to the backend that failed in a row.", func(s *backendState) float64 {
+			_, failures := s.breaker.State()
+			return float64(failures)
+		}},
+		{"multitime_backend_last_success_timestamp_seconds", "When the backend last handled a request, or 0 if it has not since startup.", func(s *backendState) float64 {
+			t := s.breaker.LastSuccess()
+			if t.IsZero() {
+				return 0
+			}
+			return float64(t.UnixNano()) / float64(time.Second)
+		}},
+	}
+
+	cfg := currentConfig()
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, b := range cfg.Backends {
+			labels := formatLabels([]string{"backend"}, []string{b.Name})
+			fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatValue(g.value(stateFor(b))))
+		}
+	}
+}
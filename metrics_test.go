@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	counter := newMetricVec("test_total", "counter", "A test counter.", "backend")
+	counter.add(2, `say "hi"`)
+	counter.add(1, "a")
+
+	histogram := newHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "backend")
+	histogram.observe(0.1, "a")
+	histogram.observe(0.5, "a")
+	histogram.observe(3, "a")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	histogram.write(&buf)
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{backend="a"} 1
+test_total{backend="say \"hi\""} 2
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{backend="a",le="0.1"} 1
+test_seconds_bucket{backend="a",le="1"} 2
+test_seconds_bucket{backend="a",le="+Inf"} 3
+test_seconds_sum{backend="a"} 3.6
+test_seconds_count{backend="a"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", buf.String(), expected)
+	}
+}
+
+// resetMetrics clears the counters so a test sees only its own requests.
+func resetMetrics() {
+	for _, m := range []*metricVec{heartbeatsReceived, heartbeatsForwarded, heartbeatsFailed, upstreamRetries, upstreamDuration} {
+		m.mu.Lock()
+		m.series = map[string]*series{}
+		m.mu.Unlock()
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	cfg := setupTestConfig(t)
+	resetMetrics()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	cfg.Backends[0].Name = "Metrics Primary"
+	cfg.Backends[0].URL = ok.URL
+	cfg.Backends[1].Name = "Metrics Secondary"
+	cfg.Backends[1].URL = failing.URL
+	// Keep the drainer from retrying while the metrics are read.
+	cfg.Backends[1].Retry = RetryPolicy{BaseDelay: Duration{time.Minute}}
+
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", strings.NewReader(`{"entity":"main.go","type":"file","time":1700000000}`))
+	handleHeartbeat(httptest.NewRecorder(), req)
+	detached.Wait()
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	handleMetrics(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	for _, line := range []string{
+		`multitime_heartbeats_received_total{endpoint="heartbeats"} 1`,
+		`multitime_heartbeats_forwarded_total{backend="Metrics Primary",endpoint="heartbeats"} 1`,
+		`multitime_heartbeats_failed_total{backend="Metrics Secondary",endpoint="heartbeats"} 1`,
+		`multitime_upstream_request_duration_seconds_count{backend="Metrics Secondary",endpoint="heartbeats"} 1`,
+		`multitime_outbox_depth{backend="Metrics Secondary"} 1`,
+		`multitime_backend_consecutive_failures{backend="Metrics Secondary"} 1`,
+		`multitime_circuit_breaker_state{backend="Metrics Primary"} 0`,
+		`multitime_backend_last_success_timestamp_seconds{backend="Metrics Secondary"} 0`,
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentSize is the size at which the active segment is rotated, provided
+	// most of it is made up of acknowledged entries.
+	segmentSize = 4 << 20
+	// maxRecordSize bounds a single outbox record when replaying segments.
+	maxRecordSize = 32 << 20
+)
+
+// Entry is a single heartbeat (or bulk array of heartbeats) waiting to be
+// delivered to one backend.
+type Entry struct {
+	ID        uint64 `json:"id"`
+	Bulk      bool   `json:"bulk,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// MachineName is sent as the X-Machine-Name header.
+	MachineName string          `json:"machine_name,omitempty"`
+	Body        json.RawMessage `json:"body"`
+	Queued      time.Time       `json:"queued"`
+	// Reason records why a dead-lettered entry was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// record is one line of a segment file.
+type record struct {
+	Op    string `json:"op"`
+	ID    uint64 `json:"id"`
+	Entry *Entry `json:"entry,omitempty"`
+}
+
+type pendingEntry struct {
+	entry Entry
+	seg   uint64
+	size  int64
+}
+
+// Outbox is a durable, per-backend queue of heartbeats. Entries are appended
+// to segment files as JSON lines and fsynced before Append returns; an
+// acknowledgement is written as a separate record. Old segments are compacted
+// by carrying their pending entries forward into the active segment.
+type Outbox struct {
+	dir string
+
+	mu         sync.Mutex
+	active     *os.File
+	activeSeq  uint64
+	activeSize int64
+	closed     []uint64
+	pending    map[uint64]*pendingEntry
+	claimed    map[uint64]bool
+	order      []uint64
+	liveBytes  int64
+	nextID     uint64
+}
+
+func openOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:     dir,
+		pending: make(map[uint64]*pendingEntry),
+		claimed: make(map[uint64]bool),
+		nextID:  1,
+	}
+
+	seqs, err := o.segmentSeqs()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		if err := o.replay(seq); err != nil {
+			return nil, fmt.Errorf("replaying outbox segment %d: %w", seq, err)
+		}
+	}
+	o.closed = seqs
+
+	var next uint64 = 1
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+	if err := o.openSegment(next); err != nil {
+		return nil, err
+	}
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (o *Outbox) segmentPath(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%016d.seg", seq))
+}
+
+func (o *Outbox) segmentSeqs() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(o.dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// replay loads the records of a segment into the pending set. A torn record
+// at the end of the segment (from a crash mid-write) is ignored.
+func (o *Outbox) replay(seq uint64) error {
+	f, err := os.Open(o.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), maxRecordSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			slog.Warn("Skipping corrupt outbox record", "segment", o.segmentPath(seq), "error", err)
+			continue
+		}
+		switch rec.Op {
+		case "put":
+			if rec.Entry == nil {
+				continue
+			}
+			if old, ok := o.pending[rec.ID]; ok {
+				o.liveBytes -= old.size
+			} else {
+				o.order = append(o.order, rec.ID)
+			}
+			size := int64(len(line) + 1)
+			o.pending[rec.ID] = &pendingEntry{entry: *rec.Entry, seg: seq, size: size}
+			o.liveBytes += size
+		case "ack":
+			if old, ok := o.pending[rec.ID]; ok {
+				o.liveBytes -= old.size
+				delete(o.pending, rec.ID)
+			}
+		}
+		if rec.ID >= o.nextID {
+			o.nextID = rec.ID + 1
+		}
+	}
+	sort.Slice(o.order, func(i, j int) bool { return o.order[i] < o.order[j] })
+	return scanner.Err()
+}
+
+func (o *Outbox) openSegment(seq uint64) error {
+	f, err := os.OpenFile(o.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	o.active = f
+	o.activeSeq = seq
+	o.activeSize = info.Size()
+	return syncDir(o.dir)
+}
+
+// write appends a record to the active segment and fsyncs it. A record that
+// could not be fully written is cut off again, so that the next one does not
+// run into it and corrupt both.
+func (o *Outbox) write(rec record) (int64, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	data = append(data, '\n')
+	if _, err := o.active.Write(data); err != nil {
+		o.discardTail()
+		return 0, err
+	}
+	if err := o.active.Sync(); err != nil {
+		o.discardTail()
+		return 0, err
+	}
+	o.activeSize += int64(len(data))
+	return int64(len(data)), nil
+}
+
+// discardTail truncates the active segment back to its last complete record.
+// If that fails the segment is rotated instead; replay skips the torn record
+// left at its end.
+func (o *Outbox) discardTail() {
+	err := o.active.Truncate(o.activeSize)
+	if err == nil {
+		return
+	}
+	slog.Warn("Could not truncate outbox segment", "segment", o.segmentPath(o.activeSeq), "error", err)
+	if err := o.rotate(); err != nil {
+		slog.Error("Outbox rotation failed", "dir", o.dir, "error", err)
+	}
+}
+
+// Append durably stores an entry and returns it with its ID assigned. The
+// returned entry is claimed by the caller, who must Ack or Release it.
+func (o *Outbox) Append(e Entry) (Entry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e.ID = o.nextID
+	if e.Queued.IsZero() {
+		e.Queued = time.Now()
+	}
+	size, err := o.write(record{Op: "put", ID: e.ID, Entry: &e})
+	if err != nil {
+		return Entry{}, err
+	}
+	o.nextID++
+	o.pending[e.ID] = &pendingEntry{entry: e, seg: o.activeSeq, size: size}
+	o.order = append(o.order, e.ID)
+	o.liveBytes += size
+	o.claimed[e.ID] = true
+
+	if o.activeSize >= segmentSize && o.activeSize >= 2*o.liveBytes {
+		if err := o.rotate(); err != nil {
+			slog.Error("Outbox rotation failed", "dir", o.dir, "error", err)
+		}
+	}
+	return e, nil
+}
+
+// Ack marks an entry as delivered so it is never replayed.
+func (o *Outbox) Ack(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.claimed, id)
+	p, ok := o.pending[id]
+	if !ok {
+		return nil
+	}
+	if _, err := o.write(record{Op: "ack", ID: id}); err != nil {
+		return err
+	}
+	delete(o.pending, id)
+	o.liveBytes -= p.size
+
+	if len(o.pending) == 0 && o.activeSize >= 64<<10 {
+		if err := o.rotate(); err != nil {
+			slog.Error("Outbox rotation failed", "dir", o.dir, "error", err)
+		}
+	}
+	return nil
+}
+
+// Release returns a claimed entry to the queue so the drainer can retry it.
+func (o *Outbox) Release(id uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.claimed, id)
+}
+
+// ClaimBatch claims the oldest unclaimed entry and, if it is a single
+// heartbeat, up to limit-1 further single heartbeats queued after it with the
+// same user agent, so they can be sent together in one bulk request.
+func (o *Outbox) ClaimBatch(limit int) []Entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	live := o.order[:0]
+	var batch []Entry
+	done := false
+	for _, id := range o.order {
+		p, ok := o.pending[id]
+		if !ok {
+			continue
+		}
+		live = append(live, id)
+		if done || o.claimed[id] {
+			continue
+		}
+		if len(batch) > 0 && (p.entry.Bulk || p.entry.UserAgent != batch[0].UserAgent || p.entry.MachineName != batch[0].MachineName) {
+			done = true
+			continue
+		}
+		batch = append(batch, p.entry)
+		done = p.entry.Bulk || len(batch) >= limit
+	}
+	o.order = live
+
+	for _, e := range batch {
+		o.claimed[e.ID] = true
+	}
+	return batch
+}
+
+// Entries returns the entries that have not been acknowledged, oldest first.
+func (o *Outbox) Entries() []Entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries := make([]Entry, 0, len(o.pending))
+	for _, id := range o.order {
+		if p, ok := o.pending[id]; ok {
+			entries = append(entries, p.entry)
+		}
+	}
+	return entries
+}
+
+// Get returns an entry that has not been acknowledged.
+func (o *Outbox) Get(id uint64) (Entry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, ok := o.pending[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return p.entry, true
+}
+
+// Len returns the number of entries that have not been acknowledged.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Close closes the active segment. Pending entries stay on disk.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.active.Close()
+}
+
+// rotate starts a new active segment and compacts the previous ones.
+func (o *Outbox) rotate() error {
+	if err := o.active.Close(); err != nil {
+		return err
+	}
+	o.closed = append(o.closed, o.activeSeq)
+	if err := o.openSegment(o.activeSeq + 1); err != nil {
+		return err
+	}
+	return o.compact()
+}
+
+// compact copies the pending entries of every closed segment into the active
+// segment and then removes the closed segments.
+func (o *Outbox) compact() error {
+	if len(o.closed) == 0 {
+		return nil
+	}
+
+	closed := make(map[uint64]bool, len(o.closed))
+	for _, seq := range o.closed {
+		closed[seq] = true
+	}
+	for _, id := range o.order {
+		p, ok := o.pending[id]
+		if !ok || !closed[p.seg] {
+			continue
+		}
+		size, err := o.write(record{Op: "put", ID: id, Entry: &p.entry})
+		if err != nil {
+			return err
+		}
+		o.liveBytes += size - p.size
+		p.seg = o.activeSeq
+		p.size = size
+	}
+
+	for _, seq := range o.closed {
+		if err := os.Remove(o.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	o.closed = nil
+	return syncDir(o.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not every platform supports fsync on directories; the segment data
+	// itself has already been synced at this point.
+	_ = d.Sync()
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutboxReplaysPendingEntries(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatalf("openOutbox returned error: %v", err)
+	}
+	first, err := o.Append(Entry{UserAgent: "ua", Body: []byte(`{"entity":"a.go"}`)})
+	if err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	second, err := o.Append(Entry{Bulk: true, Body: []byte(`[{"entity":"b.go"}]`)})
+	if err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if err := o.Ack(first.ID); err != nil {
+		t.Fatalf("Ack returned error: %v", err)
+	}
+	o.Release(second.ID)
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// A torn write at the end of a segment must not prevent a restart.
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	f, err := os.OpenFile(segs[len(segs)-1], os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteString(`{"op":"put","id":9,"entr`)
+	f.Close()
+
+	o, err = openOutbox(dir)
+	if err != nil {
+		t.Fatalf("openOutbox returned error on reopen: %v", err)
+	}
+	defer o.Close()
+
+	if o.Len() != 1 {
+		t.Fatalf("Expected 1 pending entry after reopen, got %d", o.Len())
+	}
+	batch := o.ClaimBatch(1)
+	if len(batch) != 1 {
+		t.Fatal("Expected to claim the pending entry")
+	}
+	if e := batch[0]; e.ID != second.ID || !e.Bulk || string(e.Body) != `[{"entity":"b.go"}]` {
+		t.Errorf("Unexpected replayed entry: %+v", e)
+	}
+	if len(o.ClaimBatch(1)) != 0 {
+		t.Error("Claimed entry should not be handed out twice")
+	}
+
+	// The next ID must not collide with anything already written.
+	third, err := o.Append(Entry{Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if third.ID <= second.ID {
+		t.Errorf("Expected a fresh ID greater than %d, got %d", second.ID, third.ID)
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	o, err := openOutbox(dir)
+	if err != nil {
+		t.Fatalf("openOutbox returned error: %v", err)
+	}
+	defer o.Close()
+
+	keep, _ := o.Append(Entry{Body: []byte(`{"keep":true}`)})
+	o.Release(keep.ID)
+	o.closed = append(o.closed, o.activeSeq)
+	o.active.Close()
+	if err := o.openSegment(o.activeSeq + 1); err != nil {
+		t.Fatalf("openSegment returned error: %v", err)
+	}
+	if err := o.compact(); err != nil {
+		t.Fatalf("compact returned error: %v", err)
+	}
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segs) != 1 {
+		t.Fatalf("Expected compaction to leave 1 segment, got %d", len(segs))
+	}
+	batch := o.ClaimBatch(1)
+	if len(batch) != 1 || batch[0].ID != keep.ID {
+		t.Errorf("Expected pending entry %d to survive compaction, got %+v", keep.ID, batch)
+	}
+}
+
+func TestBackendStateQueuesFailedForwards(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var healthy atomic.Bool
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	s := stateFor(addTestBackend(cfg, Backend{Name: "Flaky Backend", URL: server.URL, APIKey: "key", Retry: RetryPolicy{MaxAttempts: 1}}))
+	resp, err := s.forward(Entry{Body: []byte(`{"entity":"main.go"}`)})
+	if err != nil {
+		t.Fatalf("forward returned error: %v", err)
+	}
+	resp.Body.Close()
+
+	if s.outbox.Len() != 1 {
+		t.Fatalf("Expected failed heartbeat to stay queued, got %d entries", s.outbox.Len())
+	}
+
+	healthy.Store(true)
+	s.flush()
+
+	if received.Load() != 1 {
+		t.Errorf("Expected the drainer to redeliver 1 heartbeat, got %d", received.Load())
+	}
+	if s.outbox.Len() != 0 {
+		t.Errorf("Expected outbox to be empty after delivery, got %d entries", s.outbox.Len())
+	}
+}
+
+func TestBackendStateRetriesWithoutOutbox(t *testing.T) {
+	cfg := setupTestConfig(t)
+	cfg.QueueDir = ""
+
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if received.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	retry := RetryPolicy{MaxAttempts: 3, BaseDelay: Duration{time.Millisecond}, MaxDelay: Duration{time.Millisecond}}
+	s := stateFor(addTestBackend(cfg, Backend{Name: "Unqueued Backend", URL: server.URL, APIKey: "key", Retry: retry}))
+	if s.outbox != nil {
+		t.Fatal("Expected no outbox without a queue directory")
+	}
+	resp, err := s.forward(Entry{Body: []byte(`{"entity":"main.go"}`)})
+	if err != nil {
+		t.Fatalf("forward returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected the first attempt to be answered, got %d", resp.StatusCode)
+	}
+
+	detached.Wait()
+	if received.Load() != 3 {
+		t.Errorf("Expected the heartbeat to be retried up to 3 attempts, got %d", received.Load())
+	}
+	if _, failures := s.breaker.State(); failures != 0 {
+		t.Errorf("Expected the delivery to reset the breaker's failures, got %d", failures)
+	}
+}
+
+func TestQueueName(t *testing.T) {
+	names := []string{"wakatime", "Foo Bar", "foo-bar", "日本", "中国", "Wakapi (home)"}
+	seen := map[string]string{}
+	for _, name := range names {
+		dir := queueName(name)
+		if dir == "" || strings.ContainsAny(dir, " /()") {
+			t.Errorf("queueName(%q) = %q is not a safe directory name", name, dir)
+		}
+		if other, ok := seen[dir]; ok {
+			t.Errorf("%q and %q share the queue directory %q", name, other, dir)
+		}
+		seen[dir] = name
+	}
+	if dir := queueName("wakatime"); dir != "wakatime" {
+		t.Errorf("Expected a safe name to be kept as is, got %q", dir)
+	}
+}
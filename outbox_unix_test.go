@@ -0,0 +1,49 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestOutboxDiscardsFailedWrite(t *testing.T) {
+	o, err := openOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("openOutbox returned error: %v", err)
+	}
+	defer o.Close()
+	if _, err := o.Append(Entry{Body: []byte(`{"entity":"a.go"}`)}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+
+	// Let only part of the next record reach the segment, as a full disk would.
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Skipf("Cannot read file size limit: %v", err)
+	}
+	small := limit
+	small.Cur = uint64(o.activeSize) + 10
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small); err != nil {
+		t.Skipf("Cannot lower file size limit: %v", err)
+	}
+	_, err = o.Append(Entry{Body: []byte(`{"entity":"b.go"}`)})
+	syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err == nil {
+		t.Fatal("Expected Append to fail past the file size limit")
+	}
+
+	if _, err := o.Append(Entry{Body: []byte(`{"entity":"c.go"}`)}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	o.Close()
+	o, err = openOutbox(o.dir)
+	if err != nil {
+		t.Fatalf("openOutbox returned error on reopen: %v", err)
+	}
+	defer o.Close()
+	batch := o.ClaimBatch(10)
+	if len(batch) != 2 || string(batch[0].Body) != `{"entity":"a.go"}` || string(batch[1].Body) != `{"entity":"c.go"}` {
+		t.Errorf("Expected a.go and c.go to survive a reopen, got %+v", batch)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PrivacyConfig hides details of heartbeats from a backend, mirroring the
+// hide_* options of wakatime.cfg. Hidden names are replaced by a hash that is
+// stable per backend, so time is still grouped by project, branch and file.
+type PrivacyConfig struct {
+	HideFileNames    bool `toml:"hide_file_names"`
+	HideProjectNames bool `toml:"hide_project_names"`
+	HideBranchNames  bool `toml:"hide_branch_names"`
+	// Names matching one of these regular expressions are sent as is.
+	FileAllowlist    []string `toml:"file_allowlist"`
+	ProjectAllowlist []string `toml:"project_allowlist"`
+	BranchAllowlist  []string `toml:"branch_allowlist"`
+	// Salt keys the hashes so hidden names cannot be recovered by hashing
+	// likely candidates.
+	Salt string `toml:"salt"`
+}
+
+func (c PrivacyConfig) enabled() bool {
+	return c.HideFileNames || c.HideProjectNames || c.HideBranchNames
+}
+
+// redactor is a PrivacyConfig with its allowlists compiled.
+type redactor struct {
+	cfg      PrivacyConfig
+	files    []*regexp.Regexp
+	projects []*regexp.Regexp
+	branches []*regexp.Regexp
+}
+
+func (c PrivacyConfig) compile() (*redactor, error) {
+	r := &redactor{cfg: c}
+	for _, list := range []struct {
+		name     string
+		patterns []string
+		compiled *[]*regexp.Regexp
+	}{
+		{"file_allowlist", c.FileAllowlist, &r.files},
+		{"project_allowlist", c.ProjectAllowlist, &r.projects},
+		{"branch_allowlist", c.BranchAllowlist, &r.branches},
+	} {
+		for _, pattern := range list.patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s pattern %q: %w", list.name, pattern, err)
+			}
+			*list.compiled = append(*list.compiled, re)
+		}
+	}
+	return r, nil
+}
+
+// redact returns the heartbeat with the configured names hidden. A nil
+// redactor hides nothing.
+func (r *redactor) redact(h Heartbeat) Heartbeat {
+	if r == nil || !r.cfg.enabled() {
+		return h
+	}
+
+	if r.cfg.HideFileNames && h.Type == "file" && !anyMatch(r.files, h.Entity) {
+		// Keep the extension so the file type is still recognisable, and
+		// drop details that describe the file's contents.
+		h.Entity = r.hash("file", h.Entity) + path.Ext(strings.ReplaceAll(h.Entity, `\`, "/"))
+		h.Dependencies = nil
+		h.Lines = nil
+		h.LineNo = nil
+		h.CursorPos = nil
+	}
+	if r.cfg.HideProjectNames && h.Project != "" && !anyMatch(r.projects, h.Project) {
+		h.Project = r.hash("project", h.Project)
+	}
+	if r.cfg.HideBranchNames && h.Branch != "" && !anyMatch(r.branches, h.Branch) {
+		h.Branch = r.hash("branch", h.Branch)
+	}
+	return h
+}
+
+// hash obfuscates a name deterministically.
+func (r *redactor) hash(kind, name string) string {
+	mac := hmac.New(sha256.New, []byte(r.cfg.Salt))
+	mac.Write([]byte(kind + "\x00" + name))
+	return hex.EncodeToString(mac.Sum(nil))[:12]
+}
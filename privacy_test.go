@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedactorRedact(t *testing.T) {
+	r, err := PrivacyConfig{
+		HideFileNames:    true,
+		HideProjectNames: true,
+		HideBranchNames:  true,
+		ProjectAllowlist: []string{"^oss-"},
+		Salt:             "pepper",
+	}.compile()
+	if err != nil {
+		t.Fatalf("Failed to compile privacy rules: %v", err)
+	}
+
+	lineno := 12
+	h := Heartbeat{Entity: "/work/secret/plan.go", Type: "file", Project: "secret", Branch: "feature/x", LineNo: &lineno, Dependencies: []string{"fmt"}}
+	got := r.redact(h)
+
+	if strings.Contains(got.Entity, "secret") || !strings.HasSuffix(got.Entity, ".go") {
+		t.Errorf("Expected the file name to be hidden but keep its extension, got %s", got.Entity)
+	}
+	if got.Project == "secret" || got.Branch == "feature/x" {
+		t.Errorf("Expected project and branch to be hidden, got %s and %s", got.Project, got.Branch)
+	}
+	if got.LineNo != nil || got.Dependencies != nil {
+		t.Errorf("Expected file details to be dropped, got %+v", got)
+	}
+	if h.Entity != "/work/secret/plan.go" || h.LineNo == nil {
+		t.Error("Expected the original heartbeat to be left untouched")
+	}
+	if again := r.redact(h); again.Entity != got.Entity || again.Project != got.Project {
+		t.Error("Expected hashing to be deterministic")
+	}
+
+	if got := r.redact(Heartbeat{Project: "oss-lib", Type: "app", Entity: "Figma"}); got.Project != "oss-lib" || got.Entity != "Figma" {
+		t.Errorf("Expected allowlisted projects and non-file entities to be kept, got %+v", got)
+	}
+
+	other, _ := PrivacyConfig{HideProjectNames: true, Salt: "salt"}.compile()
+	if other.redact(h).Project == got.Project {
+		t.Error("Expected different salts to give different hashes")
+	}
+	if (*redactor)(nil).redact(h).Project != "secret" {
+		t.Error("Expected a backend without privacy rules to see everything")
+	}
+}
+
+func TestHandleHeartbeatPrivacy(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var mu sync.Mutex
+	forwarded := map[string]Heartbeat{}
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var h Heartbeat
+			json.NewDecoder(r.Body).Decode(&h)
+			mu.Lock()
+			forwarded[name] = h
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}))
+	}
+	private, public := newServer("private"), newServer("public")
+	defer private.Close()
+	defer public.Close()
+
+	cfg.Backends[0].URL = private.URL
+	cfg.Backends[1].URL = public.URL
+	cfg.Backends[1].Privacy = PrivacyConfig{HideFileNames: true, HideProjectNames: true}
+
+	body := `{"entity":"/work/plan.go","type":"file","time":1700000000,"project":"secret"}`
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+	detached.Wait()
+
+	if h := forwarded["private"]; h.Entity != "/work/plan.go" || h.Project != "secret" {
+		t.Errorf("Expected the private backend to get full details, got %+v", h)
+	}
+	if h := forwarded["public"]; h.Entity == "/work/plan.go" || h.Project == "secret" || h.Project == "" {
+		t.Errorf("Expected the public backend to get hidden names, got %+v", h)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultProbeInterval is how often backends are probed unless configured.
+const defaultProbeInterval = 5 * time.Minute
+
+// probeResult is the outcome of the last probe of a backend.
+type probeResult struct {
+	checkedAt time.Time
+	err       error
+}
+
+func (p probeResult) ok() bool {
+	return !p.checkedAt.IsZero() && p.err == nil
+}
+
+// probeBackend checks that a backend is reachable and accepts its API key by
+// fetching the current user.
+func probeBackend(b Backend) error {
+	resp, err := fetchCurrentUser(context.Background(), b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("API key rejected with %s", resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// probeBackends probes every backend once, concurrently, and records the
+// results.
+func probeBackends(cfg *Config) {
+	var wg sync.WaitGroup
+	for _, b := range cfg.Backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := stateFor(b)
+			err := probeBackend(b)
+			previous := s.lastProbe()
+			s.setProbe(probeResult{checkedAt: time.Now(), err: err})
+
+			switch {
+			case err != nil:
+				slog.Error("Backend probe failed", "backend", b.Name, "error", err)
+			case previous.err != nil:
+				slog.Info("Backend probe succeeded again", "backend", b.Name)
+			default:
+				slog.Debug("Backend probe succeeded", "backend", b.Name)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runProbes probes the backends straight away and then every probe_interval
+// until stop is closed. The interval is read again after each round so a
+// reload can change it.
+func runProbes(stop <-chan struct{}) {
+	for {
+		cfg := currentConfig()
+		probeBackends(cfg)
+
+		interval := cfg.ProbeInterval.Duration
+		if interval <= 0 {
+			interval = defaultProbeInterval
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *backendState) setProbe(p probeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probe = p
+}
+
+func (s *backendState) lastProbe() probeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.probe
+}
+
+// handleHealthz reports that the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether multitime can usefully take heartbeats: the
+// config is loaded, the queue directory is writable and the most preferred
+// backend passed its last probe.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = secrets.redact(err.Error())
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	cfg := currentConfig()
+	if cfg == nil {
+		check("config", errors.New("not loaded"))
+	} else {
+		check("config", nil)
+		check("queue", checkWritable(cfg.QueueDir))
+
+		if responders := cfg.responders(); len(responders) == 0 {
+			check("primary", errors.New("no backend configured"))
+		} else {
+			p := stateFor(responders[0]).lastProbe()
+			if p.checkedAt.IsZero() {
+				check("primary", errors.New("not probed yet"))
+			} else {
+				check("primary", p.err)
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	payload, _ := json.Marshal(map[string]any{"ready": ready, "checks": checks})
+	writeJSON(w, status, payload)
+}
+
+// checkWritable reports whether files can be created in a directory.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
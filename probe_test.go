@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProbeBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/users/current" {
+			t.Errorf("Unexpected probe path %s", r.URL.Path)
+		}
+		switch r.Header.Get("Authorization") {
+		case "Basic " + base64.StdEncoding.EncodeToString([]byte("good-key")):
+			w.Write([]byte(`{"data":{"id":"1"}}`))
+		case "Basic " + base64.StdEncoding.EncodeToString([]byte("broken-key")):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"good-key", ""},
+		{"revoked-key", "API key rejected with 401 Unauthorized"},
+		{"broken-key", "unexpected status 500 Internal Server Error"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			err := probeBackend(Backend{Name: "Probed", URL: server.URL, APIKey: tc.key})
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	cfg.Backends[0].URL = server.URL
+	cfg.Backends[1].URL = server.URL
+
+	readyz := func() (int, map[string]string) {
+		rr := httptest.NewRecorder()
+		handleReadyz(rr, httptest.NewRequest("GET", "/readyz", nil))
+		var body struct {
+			Checks map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode readyz response: %v", err)
+		}
+		return rr.Code, body.Checks
+	}
+
+	if code, checks := readyz(); code != http.StatusServiceUnavailable || checks["primary"] != "not probed yet" {
+		t.Errorf("Expected not ready before the first probe, got %d %v", code, checks)
+	}
+
+	probeBackends(cfg)
+	if code, checks := readyz(); code != http.StatusOK || checks["queue"] != "ok" || checks["primary"] != "ok" {
+		t.Errorf("Expected ready after a successful probe, got %d %v", code, checks)
+	}
+
+	status = http.StatusForbidden
+	probeBackends(cfg)
+	if code, checks := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(checks["primary"], "API key rejected") {
+		t.Errorf("Expected not ready with a rejected key, got %d %v", code, checks)
+	}
+
+	rr := httptest.NewRecorder()
+	handleAdminBackends(rr, httptest.NewRequest("GET", "/admin/backends", nil))
+	var statuses []backendStatus
+	json.Unmarshal(rr.Body.Bytes(), &statuses)
+	if len(statuses) != 2 || statuses[1].Probe != "API key rejected with 403 Forbidden" || statuses[1].ProbedAt == nil {
+		t.Errorf("Expected the admin status to report the probe, got %+v", statuses)
+	}
+
+	// A queue directory that cannot be written to is not ready either.
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o600)
+	status = http.StatusOK
+	probeBackends(cfg)
+	cfg.QueueDir = file
+	if code, checks := readyz(); code != http.StatusServiceUnavailable || checks["queue"] == "ok" {
+		t.Errorf("Expected not ready with an unwritable queue, got %d %v", code, checks)
+	}
+}
+
+func TestHandleHealthz(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleHealthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok\n" {
+		t.Errorf("Expected 200 ok, got %d %q", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+// watchConfig reloads the config file on SIGHUP and whenever it changes on
+// disk, until stop is closed.
+func watchConfig(path string, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	last := configStamp(path)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			if configStamp(path) == last {
+				continue
+			}
+			slog.Info("Config file changed, reloading")
+		}
+
+		last = configStamp(path)
+		if err := reloadConfig(path); err != nil {
+			slog.Error("Keeping the current config, reload failed", "error", err)
+		}
+	}
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func configStamp(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// reloadConfig validates the config file and, if it is valid, swaps it in.
+// Requests already in flight finish against the previous config.
+func reloadConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	old := currentConfig()
+	if cfg.Port != old.Port {
+		slog.Warn("Changing the port needs a restart", "port", old.Port, "new_port", cfg.Port)
+		cfg.Port = old.Port
+	}
+	if cfg.Admin.Listen != old.Admin.Listen {
+		slog.Warn("Changing the admin listen address needs a restart", "listen", old.Admin.Listen)
+		cfg.Admin.Listen = old.Admin.Listen
+	}
+	if cfg.QueueDir != old.QueueDir {
+		slog.Warn("Changing queue_dir needs a restart", "queue_dir", old.QueueDir)
+		cfg.QueueDir = old.QueueDir
+	}
+	if cfg.LogFile != old.LogFile || cfg.LogFormat != old.LogFormat ||
+		cfg.LogMaxSizeMB != old.LogMaxSizeMB || cfg.LogMaxBackups != old.LogMaxBackups {
+		slog.Warn("Changing log_file, log_format or log rotation needs a restart")
+		cfg.LogFile, cfg.LogFormat = old.LogFile, old.LogFormat
+		cfg.LogMaxSizeMB, cfg.LogMaxBackups = old.LogMaxSizeMB, old.LogMaxBackups
+	}
+	// The level can change straight away, since every logger shares it.
+	logLevel.Set(cfg.level())
+
+	setConfig(cfg)
+	syncBackends(cfg)
+	slog.Info("Reloaded config", "path", path, "backends", len(cfg.Backends))
+	return nil
+}
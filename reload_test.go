@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	originalWriter := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(originalWriter)
+	defer stopBackends()
+	defer logLevel.Set(logLevel.Level())
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	write(`
+port = 3005
+queue_dir = "` + filepath.ToSlash(filepath.Join(dir, "queue")) + `"
+
+[[backends]]
+name = "Primary Backend"
+url = "https://primary.example.com/api"
+api_key = "key1"
+is_primary = true
+
+[[backends]]
+name = "Old Backend"
+url = "https://old.example.com/api"
+api_key = "key2"
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	setConfig(cfg)
+	syncBackends(cfg)
+	old := cfg.Backends[0]
+
+	write(`
+port = 4000
+log_level = "warn"
+log_format = "json"
+
+[[backends]]
+name = "Primary Backend"
+url = "https://primary2.example.com/api"
+api_key = "key1"
+is_primary = true
+
+[[backends]]
+name = "New Backend"
+url = "https://new.example.com/api"
+api_key = "key3"
+`)
+	if err := reloadConfig(path); err != nil {
+		t.Fatalf("reloadConfig returned error: %v", err)
+	}
+
+	reloaded := currentConfig()
+	if reloaded == cfg || len(reloaded.Backends) != 2 || reloaded.Backends[1].Name != "New Backend" {
+		t.Fatalf("Expected the new config to be swapped in, got %+v", reloaded)
+	}
+	if reloaded.Port != 3005 || reloaded.QueueDir != cfg.QueueDir {
+		t.Errorf("Expected port and queue_dir to keep their old values, got %d and %s", reloaded.Port, reloaded.QueueDir)
+	}
+	if logLevel.Level() != slog.LevelWarn || reloaded.LogFormat != logFormatText {
+		t.Errorf("Expected the log level to change and the format to need a restart, got %v and %s", logLevel.Level(), reloaded.LogFormat)
+	}
+	if cfg.Backends[0].URL != "https://primary.example.com/api" {
+		t.Error("Expected the old snapshot to be left untouched")
+	}
+
+	statesMu.Lock()
+	_, hasOld := states["Old Backend"]
+	_, hasNew := states["New Backend"]
+	statesMu.Unlock()
+	if hasOld || !hasNew {
+		t.Errorf("Expected the removed backend to stop and the new one to start, got old=%v new=%v", hasOld, hasNew)
+	}
+
+	// A request still using the old snapshot does not roll back the backend.
+	if got := stateFor(old).current().URL; got != "https://primary2.example.com/api" {
+		t.Errorf("Expected the reloaded URL to stick, got %s", got)
+	}
+
+	// Nor does it bring back a removed backend.
+	if s := stateFor(cfg.Backends[1]); s.ctx.Err() == nil || s.outbox != nil {
+		t.Error("Expected a removed backend to get a stopped state")
+	}
+	statesMu.Lock()
+	_, hasOld = states["Old Backend"]
+	statesMu.Unlock()
+	if hasOld {
+		t.Error("Expected the removed backend to stay stopped")
+	}
+
+	// An invalid file leaves the current config in place.
+	write(`port = "not a number"`)
+	if err := reloadConfig(path); err == nil {
+		t.Error("Expected an error for an invalid config")
+	}
+	if currentConfig() != reloaded {
+		t.Error("Expected the config to be kept after a failed reload")
+	}
+}
+
+func TestRemovingBackendAbortsItsRequests(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is
+		// read.
+		io.Copy(io.Discard, r.Body)
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	s := stateFor(addTestBackend(cfg, Backend{Name: "Stuck Backend", URL: server.URL, Retry: RetryPolicy{MaxAttempts: 5, BaseDelay: Duration{time.Minute}}}))
+	if err := s.enqueue(Entry{Body: []byte(`{"entity":"main.go"}`)}); err != nil {
+		t.Fatalf("enqueue returned error: %v", err)
+	}
+	<-requested
+
+	next := &Config{QueueDir: cfg.QueueDir, Backends: slices.Clone(cfg.Backends[:2])}
+	setConfig(next)
+	synced := make(chan struct{})
+	go func() {
+		syncBackends(next)
+		close(synced)
+	}()
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected removing the backend to abort its request and retries")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how often and how quickly a backend is retried.
+type RetryPolicy struct {
+	MaxAttempts   int      `toml:"max_attempts"`
+	BaseDelay     Duration `toml:"base_delay"`
+	MaxDelay      Duration `toml:"max_delay"`
+	Jitter        float64  `toml:"jitter"`
+	RetryStatuses []int    `toml:"retry_statuses"`
+}
+
+var defaultRetryStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooEarly,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// withDefaults fills in any unset fields.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.BaseDelay.Duration <= 0 {
+		p.BaseDelay.Duration = 500 * time.Millisecond
+	}
+	if p.MaxDelay.Duration <= 0 {
+		p.MaxDelay.Duration = 30 * time.Second
+	}
+	if p.MaxDelay.Duration < p.BaseDelay.Duration {
+		p.MaxDelay.Duration = p.BaseDelay.Duration
+	}
+	if p.RetryStatuses == nil {
+		p.RetryStatuses = defaultRetryStatuses
+	}
+	return p
+}
+
+// retryable reports whether a response with this status should be retried.
+func (p RetryPolicy) retryable(status int) bool {
+	return slices.Contains(p.RetryStatuses, status)
+}
+
+// backoff returns the delay before retry number n (starting at 1), doubling
+// from BaseDelay up to MaxDelay and randomised by ±Jitter.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	delay := float64(p.BaseDelay.Duration) * math.Pow(2, float64(n-1))
+	if delay > float64(p.MaxDelay.Duration) {
+		delay = float64(p.MaxDelay.Duration)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// retryAfter parses the Retry-After header of a 429 or 503 response, which may
+// be either a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := at.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sendOnce sends an entry without retrying, for callers that cannot wait out
+// a backoff. Like sendWithRetry, it returns how long to wait before trying
+// again.
+func sendOnce(ctx context.Context, b Backend, e Entry) (*http.Response, time.Duration, error) {
+	b.Retry.MaxAttempts = 1
+	return sendWithRetry(ctx, b, e)
+}
+
+// errShuttingDown means a retry was abandoned because multitime is exiting.
+var errShuttingDown = errors.New("shutting down")
+
+// sendWithRetry sends an entry, retrying transport errors and retryable
+// statuses according to the backend's retry policy. If the backend asks to be
+// left alone for longer than MaxDelay, it gives up early and returns how long
+// the caller should wait before trying again. It also gives up, with
+// errShuttingDown, if the shutdown deadline passes while it is waiting, and
+// as soon as ctx is cancelled.
+func sendWithRetry(ctx context.Context, b Backend, e Entry) (resp *http.Response, wait time.Duration, err error) {
+	if e.Bulk && b.MaxBulkSize > 0 {
+		if heartbeats, err := splitBulk(e.Body); err == nil && len(heartbeats) > b.MaxBulkSize {
+			return sendChunked(ctx, b, e, heartbeats)
+		}
+	}
+
+	defer func() { recordDelivery(b, e, resp, err) }()
+	policy := b.Retry.withDefaults()
+
+	for attempt := 1; ; attempt++ {
+		resp, err = send(ctx, b, e)
+		if err == nil && !policy.retryable(resp.StatusCode) {
+			return resp, 0, nil
+		}
+
+		delay := policy.backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(resp, time.Now()); ok {
+				delay = after
+				if after > policy.MaxDelay.Duration {
+					slog.Debug("Backend asked to retry later, deferring", "backend", b.Name, "retry_after", after)
+					return resp, after, nil
+				}
+			}
+		}
+
+		if attempt >= policy.MaxAttempts {
+			return resp, delay, err
+		}
+
+		if err != nil {
+			slog.Debug("Attempt failed, retrying", "backend", b.Name, "attempt", attempt, "delay", delay, "error", err)
+		} else {
+			slog.Debug("Attempt failed, retrying", "backend", b.Name, "attempt", attempt, "delay", delay, "status", resp.StatusCode)
+			resp.Body.Close()
+		}
+		upstreamRetries.add(1, b.Name)
+		select {
+		case <-time.After(delay):
+		case <-givingUp():
+			return nil, delay, errShuttingDown
+		case <-ctx.Done():
+			return nil, delay, ctx.Err()
+		}
+	}
+}
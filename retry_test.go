@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay: Duration{100 * time.Millisecond},
+		MaxDelay:  Duration{time.Second},
+	}.withDefaults()
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, want := range expected {
+		if got := policy.backoff(i + 1); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := policy.backoff(1)
+		if got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Fatalf("Jittered backoff %s out of range", got)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		status int
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"Seconds", http.StatusTooManyRequests, "120", 2 * time.Minute, true},
+		{"HTTP date", http.StatusServiceUnavailable, now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{"Ignored on other statuses", http.StatusBadGateway, "120", 0, false},
+		{"Missing header", http.StatusTooManyRequests, "", 0, false},
+		{"Garbage", http.StatusTooManyRequests, "soon", 0, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+			if tc.header != "" {
+				resp.Header.Set("Retry-After", tc.header)
+			}
+			got, ok := retryAfter(resp, now)
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("retryAfter() = %s, %v, want %s, %v", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	backend := Backend{
+		Name: "Test Backend",
+		URL:  server.URL,
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   Duration{time.Millisecond},
+		},
+	}
+
+	resp, _, err := sendWithRetry(context.Background(), backend, Entry{Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("sendWithRetry returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+
+	// A Retry-After longer than the maximum delay is handed back to the caller.
+	calls.Store(1)
+	backend.Retry.MaxDelay = Duration{time.Millisecond}
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	resp, wait, err := sendWithRetry(context.Background(), backend, Entry{Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("sendWithRetry returned error: %v", err)
+	}
+	resp.Body.Close()
+	if wait != time.Minute {
+		t.Errorf("Expected to be told to wait 1m, got %s", wait)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected a single attempt, got %d", calls.Load()-1)
+	}
+
+	// Non-retryable statuses are returned immediately.
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	resp, _, err = sendWithRetry(context.Background(), backend, Entry{Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("sendWithRetry returned error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
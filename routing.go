@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// errNotRouted is reported for a backend whose routing rules exclude every
+// heartbeat in a request.
+var errNotRouted = errors.New("not routed to this backend")
+
+// RoutingRule selects heartbeats. Projects and entities are globs where *
+// matches within a path segment and ** matches across segments, branches are
+// regular expressions, and categories and languages are compared ignoring
+// case.
+type RoutingRule struct {
+	Projects   []string `toml:"projects"`
+	Entities   []string `toml:"entities"`
+	Branches   []string `toml:"branches"`
+	Categories []string `toml:"categories"`
+	Languages  []string `toml:"languages"`
+}
+
+// RoutingConfig decides which heartbeats a backend receives. A heartbeat must
+// match every field set in Include and none of the fields set in Exclude.
+type RoutingConfig struct {
+	Include RoutingRule `toml:"include"`
+	Exclude RoutingRule `toml:"exclude"`
+}
+
+type compiledRule struct {
+	projects   []*regexp.Regexp
+	entities   []*regexp.Regexp
+	branches   []*regexp.Regexp
+	categories []string
+	languages  []string
+}
+
+// router is a RoutingConfig with its patterns compiled.
+type router struct {
+	include compiledRule
+	exclude compiledRule
+}
+
+func (c RoutingConfig) compile() (*router, error) {
+	include, err := c.Include.compile()
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	exclude, err := c.Exclude.compile()
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	return &router{include: include, exclude: exclude}, nil
+}
+
+func (r RoutingRule) compile() (compiledRule, error) {
+	c := compiledRule{categories: r.Categories, languages: r.Languages}
+	for _, glob := range r.Projects {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return c, fmt.Errorf("invalid project glob %q: %w", glob, err)
+		}
+		c.projects = append(c.projects, re)
+	}
+	for _, glob := range r.Entities {
+		re, err := globRegexp(glob)
+		if err != nil {
+			return c, fmt.Errorf("invalid entity glob %q: %w", glob, err)
+		}
+		c.entities = append(c.entities, re)
+	}
+	for _, pattern := range r.Branches {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return c, fmt.Errorf("invalid branch pattern %q: %w", pattern, err)
+		}
+		c.branches = append(c.branches, re)
+	}
+	return c, nil
+}
+
+// globRegexp translates a glob into an anchored regular expression.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// routes reports whether the heartbeat should be sent to the backend. A nil
+// router sends everything.
+func (r *router) routes(h Heartbeat) bool {
+	if r == nil {
+		return true
+	}
+	return !slices.Contains(r.include.matches(h), false) && !slices.Contains(r.exclude.matches(h), true)
+}
+
+// matches checks the heartbeat against each field that is set in the rule.
+func (c compiledRule) matches(h Heartbeat) []bool {
+	var results []bool
+	if len(c.projects) > 0 {
+		results = append(results, anyMatch(c.projects, h.Project))
+	}
+	if len(c.entities) > 0 {
+		results = append(results, anyMatch(c.entities, strings.ReplaceAll(h.Entity, `\`, "/")))
+	}
+	if len(c.branches) > 0 {
+		results = append(results, h.Branch != "" && anyMatch(c.branches, h.Branch))
+	}
+	if len(c.categories) > 0 {
+		results = append(results, containsFold(c.categories, h.Category))
+	}
+	if len(c.languages) > 0 {
+		results = append(results, containsFold(c.languages, h.Language))
+	}
+	return results
+}
+
+func anyMatch(patterns []*regexp.Regexp, s string) bool {
+	return slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool {
+		return re.MatchString(s)
+	})
+}
+
+func containsFold(values []string, s string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return strings.EqualFold(v, s)
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRouterRoutes(t *testing.T) {
+	r, err := RoutingConfig{
+		Include: RoutingRule{
+			Projects:  []string{"acme-*"},
+			Entities:  []string{"/work/**/*.go"},
+			Languages: []string{"go"},
+		},
+		Exclude: RoutingRule{
+			Branches:   []string{"^personal/"},
+			Categories: []string{"Meeting"},
+		},
+	}.compile()
+	if err != nil {
+		t.Fatalf("Failed to compile routing rules: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		heartbeat Heartbeat
+		routes    bool
+	}{
+		{"Matches every include", Heartbeat{Project: "acme-api", Entity: "/work/acme/api/main.go", Language: "Go"}, true},
+		{"Entity in the root directory", Heartbeat{Project: "acme-api", Entity: "/work/main.go", Language: "Go"}, true},
+		{"Windows path", Heartbeat{Project: "acme-api", Entity: `\work\acme\main.go`, Language: "Go"}, true},
+		{"Other project", Heartbeat{Project: "hobby", Entity: "/work/acme/main.go", Language: "Go"}, false},
+		{"Project glob stops at slashes", Heartbeat{Project: "acme-a/b", Entity: "/work/main.go", Language: "Go"}, false},
+		{"Other language", Heartbeat{Project: "acme-api", Entity: "/work/main.go", Language: "Python"}, false},
+		{"Excluded branch", Heartbeat{Project: "acme-api", Entity: "/work/main.go", Language: "Go", Branch: "personal/notes"}, false},
+		{"Excluded category", Heartbeat{Project: "acme-api", Entity: "/work/main.go", Language: "Go", Category: "meeting"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := r.routes(tc.heartbeat); got != tc.routes {
+				t.Errorf("Expected routes to be %v, got %v", tc.routes, got)
+			}
+		})
+	}
+
+	if !(*router)(nil).routes(Heartbeat{}) {
+		t.Error("Expected a backend without routing rules to receive everything")
+	}
+	if _, err := (RoutingConfig{Exclude: RoutingRule{Branches: []string{"("}}}).compile(); err == nil {
+		t.Error("Expected an error for an invalid branch pattern")
+	}
+}
+
+func TestHandleHeartbeatsBulkRouting(t *testing.T) {
+	cfg := setupTestConfig(t)
+
+	var mu sync.Mutex
+	forwarded := map[string][]string{}
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var heartbeats []Heartbeat
+			json.NewDecoder(r.Body).Decode(&heartbeats)
+			responses := make([]bulkItem, len(heartbeats))
+			mu.Lock()
+			for i, h := range heartbeats {
+				forwarded[name] = append(forwarded[name], h.Project)
+				responses[i] = bulkItem{Body: json.RawMessage(`{"data":{"backend":"` + name + `"}}`), Status: http.StatusCreated}
+			}
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(bulkResponse{Responses: responses})
+		}))
+	}
+	work, hobby := newServer("work"), newServer("hobby")
+	defer work.Close()
+	defer hobby.Close()
+
+	cfg.Backends[0].URL = work.URL
+	cfg.Backends[0].Routing = RoutingConfig{Include: RoutingRule{Projects: []string{"acme-*"}}}
+	cfg.Backends[1].URL = hobby.URL
+	cfg.Backends[1].Routing = RoutingConfig{Exclude: RoutingRule{Projects: []string{"acme-*"}}}
+
+	body := `[{"entity":"a.go","type":"file","time":1700000000,"project":"hobby"},{"entity":"b.go","type":"file","time":1700000000,"project":"acme-api"}]`
+	req, _ := http.NewRequest("POST", "/users/current/heartbeats.bulk", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	handleHeartbeatsBulk(rr, req)
+
+	if len(forwarded["work"]) != 1 || forwarded["work"][0] != "acme-api" {
+		t.Errorf("Expected only acme-api to go to the work backend, got %v", forwarded["work"])
+	}
+	if len(forwarded["hobby"]) != 1 || forwarded["hobby"][0] != "hobby" {
+		t.Errorf("Expected only hobby to go to the hobby backend, got %v", forwarded["hobby"])
+	}
+	expected := `{"responses":[[{"data":{"backend":"hobby"}},201],[{"data":{"backend":"work"}},201]]}`
+	if rr.Body.String() != expected {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// A heartbeat no backend wants is acknowledged without being forwarded.
+	cfg.Backends[1].Routing = RoutingConfig{Include: RoutingRule{Projects: []string{"hobby"}}}
+	setConfig(cfg)
+	req, _ = http.NewRequest("POST", "/users/current/heartbeats", bytes.NewReader([]byte(`{"entity":"c.go","type":"file","time":1700000000,"project":"other"}`)))
+	rr = httptest.NewRecorder()
+	handleHeartbeat(rr, req)
+	if rr.Code != http.StatusCreated || len(forwarded["work"])+len(forwarded["hobby"]) != 2 {
+		t.Errorf("Expected a local 201 without forwarding, got %d after %v", rr.Code, forwarded)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RewriteConfig changes heartbeats before they are sent to a backend. Rules
+// are applied in the order the fields are listed.
+type RewriteConfig struct {
+	// ProjectPaths sets the project of heartbeats for files under a path;
+	// the longest matching prefix wins.
+	ProjectPaths []ProjectPath `toml:"project_paths"`
+	// Projects renames projects; the first matching pattern applies.
+	Projects []PatternRewrite `toml:"projects"`
+	// Category replaces the category of every heartbeat.
+	Category string `toml:"category"`
+	// Languages sets the language of files by extension, e.g. ".tmpl".
+	Languages map[string]string `toml:"languages"`
+	// Branches renames branches; the first matching pattern applies.
+	Branches []PatternRewrite `toml:"branches"`
+}
+
+// ProjectPath maps files under Prefix to Project.
+type ProjectPath struct {
+	Prefix  string `toml:"prefix"`
+	Project string `toml:"project"`
+}
+
+// PatternRewrite replaces a value matching the Pattern regular expression
+// with Replace, which may refer to groups as $1.
+type PatternRewrite struct {
+	Pattern string `toml:"pattern"`
+	Replace string `toml:"replace"`
+}
+
+type compiledRewrite struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// rewriter is a RewriteConfig with its patterns compiled.
+type rewriter struct {
+	paths     []ProjectPath
+	projects  []compiledRewrite
+	category  string
+	languages map[string]string
+	branches  []compiledRewrite
+}
+
+func (c RewriteConfig) compile() (*rewriter, error) {
+	r := &rewriter{category: c.Category, languages: map[string]string{}}
+
+	for _, p := range c.ProjectPaths {
+		if p.Prefix == "" || p.Project == "" {
+			return nil, errors.New("project_paths entries need a prefix and a project")
+		}
+		p.Prefix = strings.TrimSuffix(strings.ReplaceAll(p.Prefix, `\`, "/"), "/")
+		r.paths = append(r.paths, p)
+	}
+	// Try the most specific prefix first.
+	slices.SortStableFunc(r.paths, func(a, b ProjectPath) int {
+		return len(b.Prefix) - len(a.Prefix)
+	})
+
+	var err error
+	if r.projects, err = compileRewrites("projects", c.Projects); err != nil {
+		return nil, err
+	}
+	if r.branches, err = compileRewrites("branches", c.Branches); err != nil {
+		return nil, err
+	}
+
+	if c.Category != "" && !slices.Contains(heartbeatCategories, c.Category) {
+		return nil, fmt.Errorf("unknown category %q", c.Category)
+	}
+	for ext, language := range c.Languages {
+		r.languages[normalizeExt(ext)] = language
+	}
+	return r, nil
+}
+
+func compileRewrites(field string, rewrites []PatternRewrite) ([]compiledRewrite, error) {
+	var compiled []compiledRewrite
+	for _, rw := range rewrites {
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", field, rw.Pattern, err)
+		}
+		compiled = append(compiled, compiledRewrite{re: re, replace: rw.Replace})
+	}
+	return compiled, nil
+}
+
+func normalizeExt(ext string) string {
+	return "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+}
+
+// rewrite returns the heartbeat with the rules applied. A nil rewriter
+// changes nothing.
+func (r *rewriter) rewrite(h Heartbeat) Heartbeat {
+	if r == nil {
+		return h
+	}
+
+	entity := strings.ReplaceAll(h.Entity, `\`, "/")
+	if h.Type == "file" {
+		for _, p := range r.paths {
+			if entity == p.Prefix || strings.HasPrefix(entity, p.Prefix+"/") {
+				h.Project = p.Project
+				break
+			}
+		}
+	}
+	h.Project = applyRewrites(r.projects, h.Project)
+	if r.category != "" {
+		h.Category = r.category
+	}
+	if h.Type == "file" {
+		if language, ok := r.languages[normalizeExt(path.Ext(entity))]; ok {
+			h.Language = language
+		}
+	}
+	h.Branch = applyRewrites(r.branches, h.Branch)
+	return h
+}
+
+func applyRewrites(rewrites []compiledRewrite, value string) string {
+	for _, rw := range rewrites {
+		if rw.re.MatchString(value) {
+			return rw.re.ReplaceAllString(value, rw.replace)
+		}
+	}
+	return value
+}
+
+// backendRules are everything that decides what a backend is sent: rewrites
+// run first, then routing on the rewritten heartbeat, then redaction.
+type backendRules struct {
+	// invalid rules send nothing.
+	invalid  bool
+	rewriter *rewriter
+	router   *router
+	redactor *redactor
+}
+
+func compileRules(b Backend) (*backendRules, error) {
+	rewriter, err := b.Rewrite.compile()
+	if err != nil {
+		return nil, fmt.Errorf("rewrite: %w", err)
+	}
+	router, err := b.Routing.compile()
+	if err != nil {
+		return nil, fmt.Errorf("routing %w", err)
+	}
+	redactor, err := b.Privacy.compile()
+	if err != nil {
+		return nil, fmt.Errorf("privacy: %w", err)
+	}
+	return &backendRules{rewriter: rewriter, router: router, redactor: redactor}, nil
+}
+
+// apply returns the heartbeat as the backend should receive it, or false if
+// the backend should not receive it. Nil rules send everything unchanged.
+func (r *backendRules) apply(h Heartbeat) (Heartbeat, bool) {
+	if r == nil {
+		return h, true
+	}
+	if r.invalid {
+		return h, false
+	}
+	h = r.rewriter.rewrite(h)
+	if !r.router.routes(h) {
+		return h, false
+	}
+	return r.redactor.redact(h), true
+}
+
+// runRulesTest implements "multitime rules test <config_file> [heartbeats_file]".
+// It reads a heartbeat or an array of heartbeats from the file, or stdin, and
+// prints what each backend would be sent.
+func runRulesTest(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: multitime rules test <config_file> [heartbeats_file]")
+	}
+	cfg, err := loadConfig(args[0])
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+
+	input := stdin
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+
+	rules := make([]*backendRules, len(cfg.Backends))
+	for i, b := range cfg.Backends {
+		if rules[i], err = compileRules(b); err != nil {
+			return fmt.Errorf("backend %q: %w", b.Name, err)
+		}
+	}
+
+	bulk := bytes.HasPrefix(bytes.TrimSpace(data), []byte("["))
+	heartbeats, rejected, err := parseHeartbeats(data, bulk, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for i := 0; len(heartbeats) > 0 || rejected[i] != nil; i++ {
+		if errs, ok := rejected[i]; ok {
+			fmt.Fprintf(stdout, "Heartbeat %d is invalid: %s\n", i, errs.errorBody())
+			continue
+		}
+		h := heartbeats[0]
+		heartbeats = heartbeats[1:]
+
+		fmt.Fprintf(stdout, "Heartbeat %d (%s):\n", i, h.Entity)
+		for j, b := range cfg.Backends {
+			out, ok := rules[j].apply(h)
+			if !ok {
+				fmt.Fprintf(stdout, "  %s: not sent\n", b.Name)
+				continue
+			}
+			encoded, err := json.Marshal(out)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "  %s: %s\n", b.Name, encoded)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriterRewrite(t *testing.T) {
+	r, err := RewriteConfig{
+		ProjectPaths: []ProjectPath{
+			{Prefix: "/work", Project: "work"},
+			{Prefix: "/work/acme/", Project: "acme"},
+		},
+		Projects:  []PatternRewrite{{Pattern: `^(.+)-wip$`, Replace: "$1"}, {Pattern: `^$`, Replace: "unknown"}},
+		Category:  "coding",
+		Languages: map[string]string{"TMPL": "Go Template"},
+		Branches:  []PatternRewrite{{Pattern: `^(feature|fix)/.*`, Replace: "$1"}},
+	}.compile()
+	if err != nil {
+		t.Fatalf("Failed to compile rewrite rules: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		heartbeat Heartbeat
+		expected  Heartbeat
+	}{
+		{
+			"Longest prefix wins",
+			Heartbeat{Entity: "/work/acme/main.go", Type: "file", Project: "garbage"},
+			Heartbeat{Entity: "/work/acme/main.go", Type: "file", Project: "acme", Category: "coding"},
+		},
+		{
+			"Prefix stops at directory boundaries",
+			Heartbeat{Entity: "/workshop/main.go", Type: "file", Project: "shop-wip"},
+			Heartbeat{Entity: "/workshop/main.go", Type: "file", Project: "shop", Category: "coding"},
+		},
+		{
+			"Empty project and language by extension",
+			Heartbeat{Entity: `C:\src\page.tmpl`, Type: "file", Category: "debugging"},
+			Heartbeat{Entity: `C:\src\page.tmpl`, Type: "file", Project: "unknown", Category: "coding", Language: "Go Template"},
+		},
+		{
+			"Branch rename",
+			Heartbeat{Entity: "Figma", Type: "app", Project: "design", Branch: "feature/login"},
+			Heartbeat{Entity: "Figma", Type: "app", Project: "design", Category: "coding", Branch: "feature"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := r.rewrite(tc.heartbeat)
+			if got.Project != tc.expected.Project || got.Category != tc.expected.Category || got.Language != tc.expected.Language || got.Branch != tc.expected.Branch {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+
+	if _, err := (RewriteConfig{Category: "napping"}).compile(); err == nil {
+		t.Error("Expected an error for an unknown category")
+	}
+	if _, err := (RewriteConfig{Projects: []PatternRewrite{{Pattern: "("}}}).compile(); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestBackendRulesApply(t *testing.T) {
+	rules, err := compileRules(Backend{
+		Rewrite: RewriteConfig{ProjectPaths: []ProjectPath{{Prefix: "/work", Project: "acme"}}},
+		Routing: RoutingConfig{Include: RoutingRule{Projects: []string{"acme"}}},
+		Privacy: PrivacyConfig{HideProjectNames: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	// Routing sees the rewritten project, and redaction runs last.
+	got, ok := rules.apply(Heartbeat{Entity: "/work/main.go", Type: "file"})
+	if !ok || got.Project == "" || got.Project == "acme" {
+		t.Errorf("Expected the rewritten project to be routed and hidden, got %+v, %v", got, ok)
+	}
+	if _, ok := rules.apply(Heartbeat{Entity: "/home/main.go", Type: "file"}); ok {
+		t.Error("Expected a heartbeat outside the project to not be sent")
+	}
+	if _, ok := (&backendRules{invalid: true}).apply(Heartbeat{}); ok {
+		t.Error("Expected invalid rules to send nothing")
+	}
+}
+
+func TestRulesCompiledPerGeneration(t *testing.T) {
+	cfg := setupTestConfig(t)
+	s := stateFor(cfg.Backends[0])
+	rules := s.rules
+	if stateFor(cfg.Backends[0]); s.rules != rules {
+		t.Error("Expected the rules to be reused within a config generation")
+	}
+
+	cfg.Backends[0].Privacy = PrivacyConfig{HideProjectNames: true}
+	setConfig(cfg)
+	if stateFor(cfg.Backends[0]); s.rules == rules {
+		t.Error("Expected the rules to be compiled again after a reload")
+	}
+}
+
+func TestRunRulesTest(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(configPath, []byte(`
+[[backends]]
+name = "Work"
+url = "https://example.com/api"
+api_key = "key1"
+is_primary = true
+
+[backends.rewrite]
+projects = [{ pattern = "^acme-.*", replace = "acme" }]
+
+[[backends]]
+name = "Hobby"
+url = "https://example2.com/api"
+api_key = "key2"
+
+[backends.routing.exclude]
+projects = ["acme-*"]
+`), 0o600)
+
+	input := `[{"entity":"main.go","type":"file","time":1700000000,"project":"acme-api"},{"entity":"bad.go"}]`
+	var out bytes.Buffer
+	if err := runRulesTest([]string{configPath}, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("runRulesTest returned error: %v", err)
+	}
+
+	expected := `Heartbeat 0 (main.go):
+  Work: {"entity":"main.go","type":"file","time":1700000000,"project":"acme"}
+  Hobby: not sent
+Heartbeat 1 is invalid: {"errors":{"time":["This field is required."],"type":["This field is required."]}}
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", out.String(), expected)
+	}
+
+	if err := runRulesTest(nil, strings.NewReader(""), &out); err == nil {
+		t.Error("Expected a usage error without a config file")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretCmdTimeout bounds how long an api_key_cmd may run.
+const secretCmdTimeout = 10 * time.Second
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateEnv replaces ${VAR} references in the config's string values
+// with the value of the environment variable. It runs on the decoded config,
+// so a value can contain quotes or backslashes without changing how the file
+// parses, and comments are never looked at. Referencing an unset variable is
+// an error, so a missing secret is not silently sent as an empty string.
+func interpolateEnv(cfg *Config, lines keyLines) configErrors {
+	var missing configErrors
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(envReference.ReplaceAllStringFunc(v.String(), func(ref string) string {
+				name := envReference.FindStringSubmatch(ref)[1]
+				value, ok := os.LookupEnv(name)
+				if !ok {
+					missing = append(missing, configProblem{lines.of(path), "undefined environment variable " + name})
+				}
+				return value
+			}))
+		case reflect.Struct:
+			for i := range v.NumField() {
+				field := v.Type().Field(i)
+				if !field.IsExported() {
+					continue
+				}
+				key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+				if key == "" {
+					key = field.Name
+				}
+				walk(v.Field(i), joinKey(path, key))
+			}
+		case reflect.Slice:
+			for i := range v.Len() {
+				if v.Index(i).Kind() == reflect.Struct {
+					walk(v.Index(i), joinKey(path, strconv.Itoa(i)))
+				} else {
+					walk(v.Index(i), path)
+				}
+			}
+		case reflect.Map:
+			// Map values cannot be set in place, so each is copied out and
+			// stored again.
+			iter := v.MapRange()
+			for iter.Next() {
+				value := reflect.New(iter.Value().Type()).Elem()
+				value.Set(iter.Value())
+				walk(value, joinKey(path, iter.Key().String()))
+				v.SetMapIndex(iter.Key(), value)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return missing
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// resolveAPIKey fills in a backend's API key from whichever source is
+// configured.
+func resolveAPIKey(b *Backend) error {
+	sources := 0
+	for _, set := range []bool{b.APIKey != "", b.APIKeyEnv != "", b.APIKeyFile != "", b.APIKeyCmd != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("set only one of api_key, api_key_env, api_key_file and api_key_cmd")
+	}
+
+	switch {
+	case b.APIKeyEnv != "":
+		key, ok := os.LookupEnv(b.APIKeyEnv)
+		if !ok || key == "" {
+			return fmt.Errorf("api_key_env: environment variable %s is not set", b.APIKeyEnv)
+		}
+		b.APIKey = key
+	case b.APIKeyFile != "":
+		data, err := os.ReadFile(b.APIKeyFile)
+		if err != nil {
+			return fmt.Errorf("api_key_file: %w", err)
+		}
+		b.APIKey = strings.TrimSpace(string(data))
+		if b.APIKey == "" {
+			return fmt.Errorf("api_key_file: %s is empty", b.APIKeyFile)
+		}
+	case b.APIKeyCmd != "":
+		key, err := runSecretCmd(b.APIKeyCmd)
+		if err != nil {
+			return fmt.Errorf("api_key_cmd: %w", err)
+		}
+		b.APIKey = key
+	}
+	return nil
+}
+
+// runSecretCmd runs a command through the shell and returns the first line of
+// its output, the way password managers print secrets.
+func runSecretCmd(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretCmdTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%q failed: %w: %s", command, err, msg)
+		}
+		return "", fmt.Errorf("%q failed: %w", command, err)
+	}
+
+	key, _, _ := strings.Cut(string(out), "\n")
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("%q printed nothing", command)
+	}
+	return key, nil
+}
+
+// secretSet holds the API keys that must never appear in logs.
+type secretSet struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+var secrets = &secretSet{values: map[string]bool{}}
+
+// add registers a key, along with the Basic auth encoding it is sent in.
+func (s *secretSet) add(key string) {
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = true
+	s.values[base64.StdEncoding.EncodeToString([]byte(key))] = true
+
+	// Replace longer secrets first so one that contains another is fully
+	// redacted.
+	values := slices.SortedFunc(maps.Keys(s.values), func(a, b string) int {
+		return len(b) - len(a)
+	})
+	var pairs []string
+	for _, value := range values {
+		pairs = append(pairs, value, "[REDACTED]")
+	}
+	s.replacer = strings.NewReplacer(pairs...)
+}
+
+func (s *secretSet) redact(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.replacer == nil {
+		return text
+	}
+	return s.replacer.Replace(text)
+}
+
+// redactingWriter removes registered secrets from everything written to it.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, secrets.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("MULTITIME_TEST_HOST", "wakapi.example.com")
+	// Neither quotes and backslashes nor what looks like TOML change how
+	// the file is parsed.
+	t.Setenv("MULTITIME_TEST_KEY", "a\"b\\c\"\nis_primary = true\n[[backends]]")
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`# ${MULTITIME_TEST_UNSET} in a comment is left alone
+priority = ["${MULTITIME_TEST_HOST}"]
+
+[[backends]]
+name = "${MULTITIME_TEST_HOST}"
+url = "https://${MULTITIME_TEST_HOST}/api"
+api_key = "${MULTITIME_TEST_KEY}"
+is_primary = true
+
+[backends.headers]
+X-Origin = "$HOME/${MULTITIME_TEST_HOST}"
+`), 0o600)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	b := cfg.Backends[0]
+	if len(cfg.Backends) != 1 || b.URL != "https://wakapi.example.com/api" || cfg.Priority[0] != b.Name {
+		t.Errorf("Unexpected interpolation: %+v", cfg)
+	}
+	if b.APIKey != os.Getenv("MULTITIME_TEST_KEY") || b.Headers["X-Origin"] != "$HOME/wakapi.example.com" {
+		t.Errorf("Expected the values to be used verbatim, got %q and %v", b.APIKey, b.Headers)
+	}
+
+	os.WriteFile(path, []byte(`debug = true
+[[backends]]
+name = "Backend"
+url = "https://wakapi.example.com/api"
+api_key = "${MULTITIME_TEST_MISSING}"
+`), 0o600)
+	_, err = loadConfig(path)
+	if err == nil || err.Error() != "line 5: undefined environment variable MULTITIME_TEST_MISSING" {
+		t.Errorf("Expected an error naming the variable and line, got %v", err)
+	}
+}
+
+func TestResolveAPIKey(t *testing.T) {
+	t.Setenv("MULTITIME_TEST_KEY", "env-key")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte("file-key\n"), 0o600)
+
+	type testCase struct {
+		name    string
+		backend Backend
+		key     string
+		err     string
+	}
+	tests := []testCase{
+		{"Plain key", Backend{APIKey: "plain-key"}, "plain-key", ""},
+		{"Environment variable", Backend{APIKeyEnv: "MULTITIME_TEST_KEY"}, "env-key", ""},
+		{"Missing environment variable", Backend{APIKeyEnv: "MULTITIME_TEST_MISSING"}, "", "MULTITIME_TEST_MISSING is not set"},
+		{"File", Backend{APIKeyFile: keyFile}, "file-key", ""},
+		{"Missing file", Backend{APIKeyFile: keyFile + ".missing"}, "", "api_key_file"},
+		{"Several sources", Backend{APIKey: "plain-key", APIKeyEnv: "MULTITIME_TEST_KEY"}, "", "only one"},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests,
+			testCase{"Command", Backend{APIKeyCmd: "printf 'cmd-key\\nmetadata'"}, "cmd-key", ""},
+			testCase{"Failing command", Backend{APIKeyCmd: "echo locked >&2; exit 1"}, "", "locked"},
+		)
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			err := resolveAPIKey(&b)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveAPIKey returned error: %v", err)
+			}
+			if b.APIKey != tc.key {
+				t.Errorf("Expected key %q, got %q", tc.key, b.APIKey)
+			}
+		})
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	secrets.add("super-secret-key")
+
+	var buf bytes.Buffer
+	w := redactingWriter{&buf}
+	encoded := base64.StdEncoding.EncodeToString([]byte("super-secret-key"))
+	w.Write([]byte("key super-secret-key sent as Basic " + encoded + "\n"))
+
+	if strings.Contains(buf.String(), "super-secret") || strings.Contains(buf.String(), encoded) {
+		t.Errorf("Expected the key to be redacted, got %s", buf.String())
+	}
+	if buf.String() != "key [REDACTED] sent as Basic [REDACTED]\n" {
+		t.Errorf("Unexpected output: %s", buf.String())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is how long a shutdown waits for in-flight forwards
+// unless configured.
+const defaultShutdownTimeout = 15 * time.Second
+
+var (
+	// detached tracks forwards that outlive the request that started them.
+	detached sync.WaitGroup
+
+	// giveUp is closed once the shutdown deadline passes, so retries stop
+	// backing off and leave their heartbeats in the outbox.
+	giveUpMu sync.Mutex
+	giveUp   = make(chan struct{})
+)
+
+// givingUp returns a channel that is closed once retries should stop.
+func givingUp() <-chan struct{} {
+	giveUpMu.Lock()
+	defer giveUpMu.Unlock()
+	return giveUp
+}
+
+func stopRetrying() {
+	giveUpMu.Lock()
+	defer giveUpMu.Unlock()
+	select {
+	case <-giveUp:
+	default:
+		close(giveUp)
+	}
+}
+
+// shutdown stops the servers accepting connections and waits up to timeout
+// for the requests and forwards in flight to finish. After that, retries are
+// abandoned and the drainers and outboxes are closed; heartbeats that were
+// not delivered stay in the outbox and are sent on the next start.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("Requests still in flight at shutdown", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	forwarded := make(chan struct{})
+	go func() {
+		detached.Wait()
+		close(forwarded)
+	}()
+	select {
+	case <-forwarded:
+	case <-ctx.Done():
+		slog.Warn("Shutdown timed out, leaving unsent heartbeats in the outbox", "timeout", timeout)
+	}
+
+	stopRetrying()
+	stopBackends()
+}
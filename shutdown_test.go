@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves the heartbeat handler on a local port, the way main does.
+func startServer(t *testing.T) *http.Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: http.HandlerFunc(handleHeartbeat)}
+	go srv.Serve(ln)
+	return srv
+}
+
+// resetGiveUp lets retries back off again after a test shut down.
+func resetGiveUp() {
+	giveUpMu.Lock()
+	defer giveUpMu.Unlock()
+	giveUp = make(chan struct{})
+}
+
+func postHeartbeat(srv *http.Server) <-chan int {
+	codes := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+srv.Addr+"/users/current/heartbeats", "application/json",
+			strings.NewReader(`{"entity":"main.go","type":"file","time":1700000000}`))
+		if err != nil {
+			codes <- 0
+			return
+		}
+		resp.Body.Close()
+		codes <- resp.StatusCode
+	}()
+	return codes
+}
+
+func TestShutdownWaitsForForwards(t *testing.T) {
+	cfg := setupTestConfig(t)
+	t.Cleanup(resetGiveUp)
+
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	cfg.Backends[0].URL = server.URL
+	cfg.Backends[1].URL = server.URL
+
+	srv := startServer(t)
+	codes := postHeartbeat(srv)
+	<-arrived
+	<-arrived
+
+	done := make(chan struct{})
+	go func() {
+		shutdown([]*http.Server{srv}, 5*time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with forwards still in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if code := <-codes; code != http.StatusCreated {
+		t.Errorf("Expected the request in flight to finish with 201, got %d", code)
+	}
+	<-done
+
+	for _, b := range cfg.Backends {
+		outbox, err := openOutbox(filepath.Join(cfg.QueueDir, queueName(b.Name)))
+		if err != nil {
+			t.Fatalf("Failed to reopen outbox: %v", err)
+		}
+		if outbox.Len() != 0 {
+			t.Errorf("Expected %s to have been sent everything, %d left", b.Name, outbox.Len())
+		}
+		outbox.Close()
+	}
+}
+
+func TestShutdownDeadlineKeepsUnsentHeartbeats(t *testing.T) {
+	resetMetrics()
+	cfg := setupTestConfig(t)
+	t.Cleanup(resetGiveUp)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	cfg.Backends[0].URL = server.URL
+	cfg.Backends[1].URL = failing.URL
+	// The drainer keeps retrying, backing off for longer than the test runs.
+	cfg.Backends[1].Retry = RetryPolicy{MaxAttempts: 10, BaseDelay: Duration{50 * time.Millisecond}, MaxDelay: Duration{time.Minute}}
+
+	srv := startServer(t)
+	codes := postHeartbeat(srv)
+	if code := <-codes; code != http.StatusCreated {
+		t.Errorf("Expected the primary's response without waiting for retries, got %d", code)
+	}
+	waitFor(t, func() bool { return upstreamRetries.sum(cfg.Backends[1].Name) > 0 })
+
+	start := time.Now()
+	shutdown([]*http.Server{srv}, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected shutdown to give up on retries at the deadline, took %v", elapsed)
+	}
+	outbox, err := openOutbox(filepath.Join(cfg.QueueDir, queueName(cfg.Backends[1].Name)))
+	if err != nil {
+		t.Fatalf("Failed to reopen outbox: %v", err)
+	}
+	defer outbox.Close()
+	if outbox.Len() != 1 {
+		t.Errorf("Expected the unsent heartbeat to stay in the outbox, got %d entries", outbox.Len())
+	}
+}
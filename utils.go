@@ -2,52 +2,79 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
-	"fmt"
+	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"time"
+	"net/url"
 )
 
-func setupLogging(debug bool) {
-	if debug {
-		debugLog = log.New(os.Stdout, "DEBUG: ", log.Ltime|log.Lmicroseconds)
-	} else {
-		debugLog = log.New(io.Discard, "", 0)
+// newUpstreamRequest builds a request to a backend endpoint, authenticated
+// according to the backend's auth_scheme and carrying its custom headers.
+func newUpstreamRequest(ctx context.Context, method, path string, body io.Reader, userAgent, machineName string, backend Backend) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, backend.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", userAgent+" (JasonLovesDoggo/multitime)")
+	if machineName != "" {
+		req.Header.Set(machineHeader, machineName)
 	}
+	authorize(req, backend)
+	return req, nil
 }
 
-func forwardHeartbeat(heartbeat []byte, userAgent string, backend Backend) (*http.Response, error) {
-	req, err := http.NewRequest("POST", backend.URL+"/api/v1/users/current/heartbeats", bytes.NewReader(heartbeat))
+// doUpstream sends a request to a backend. Transport errors name the URL
+// without its query, since with auth_scheme = "query" that holds the API key
+// and errors end up in probe results and the admin API.
+func doUpstream(req *http.Request, backend Backend) (*http.Response, error) {
+	resp, err := clientFor(backend).Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		redacted := *req.URL
+		redacted.RawQuery = ""
+		urlErr.URL = redacted.String()
+	}
+	return resp, err
+}
+
+func forwardHeartbeat(ctx context.Context, heartbeat []byte, userAgent, machineName string, backend Backend) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "POST", "/v1/users/current/heartbeats", bytes.NewReader(heartbeat), userAgent, machineName, backend)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(backend.APIKey))))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", userAgent+" (JasonLovesDoggo/multitime)")
+	slog.Debug("Forwarding heartbeat", "backend", backend.Name, "url", req.URL.String())
+	return doUpstream(req, backend)
+}
 
-	debugLog.Printf("Forwarding to %s", backend.URL+"/heartbeat")
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+func forwardHeartbeats(ctx context.Context, heartbeat []byte, userAgent, machineName string, backend Backend) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "POST", "/v1/users/current/heartbeats.bulk", bytes.NewReader(heartbeat), userAgent, machineName, backend)
+	if err != nil {
+		return nil, err
 	}
-	return client.Do(req)
+
+	return doUpstream(req, backend)
 }
 
-func forwardHeartbeats(heartbeat []byte, userAgent string, backend Backend) (*http.Response, error) {
-	req, err := http.NewRequest("POST", backend.URL+"/api/v1/users/current/heartbeats.bulk", bytes.NewReader(heartbeat))
+func fetchStatusBar(ctx context.Context, userAgent string, backend Backend) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "GET", "/v1/users/current/statusbar/today", nil, userAgent, "", backend)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(backend.APIKey))))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", userAgent+" (JasonLovesDoggo/multitime)")
+	return doUpstream(req, backend)
+}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+func fetchCurrentUser(ctx context.Context, backend Backend) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "GET", "/v1/users/current", nil, "multitime", "", backend)
+	if err != nil {
+		return nil, err
 	}
-	return client.Do(req)
+
+	return doUpstream(req, backend)
 }
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -61,16 +61,11 @@ func TestForwardHeartbeat(t *testing.T) {
 		IsPrimary: true,
 	}
 
-	// Setup debug logging
-	originalDebugLog := debugLog
-	debugLog = log.New(io.Discard, "", 0) // Silence debug logs during test
-	defer func() { debugLog = originalDebugLog }()
-
 	// Test forwarding heartbeat
 	heartbeat := []byte(`{"test":"heartbeat"}`)
 	userAgent := "TestUserAgent"
 
-	resp, err := forwardHeartbeat(heartbeat, userAgent, backend)
+	resp, err := forwardHeartbeat(context.Background(), heartbeat, userAgent, "", backend)
 	if err != nil {
 		t.Fatalf("forwardHeartbeat returned error: %v", err)
 	}
@@ -119,6 +114,10 @@ func TestForwardHeartbeats(t *testing.T) {
 			t.Errorf("Expected User-Agent to contain (JasonLovesDoggo/multitime), got %s", userAgent)
 		}
 
+		if r.Header.Get("X-Machine-Name") != "devbox" {
+			t.Errorf("Expected X-Machine-Name: devbox, got %s", r.Header.Get("X-Machine-Name"))
+		}
+
 		// Read request body
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -144,16 +143,11 @@ func TestForwardHeartbeats(t *testing.T) {
 		IsPrimary: true,
 	}
 
-	// Setup debug logging
-	originalDebugLog := debugLog
-	debugLog = log.New(io.Discard, "", 0) // Silence debug logs during test
-	defer func() { debugLog = originalDebugLog }()
-
 	// Test forwarding heartbeats
 	heartbeats := []byte(`[{"test":"heartbeat1"},{"test":"heartbeat2"}]`)
 	userAgent := "TestUserAgent"
 
-	resp, err := forwardHeartbeats(heartbeats, userAgent, backend)
+	resp, err := forwardHeartbeats(context.Background(), heartbeats, userAgent, "devbox", backend)
 	if err != nil {
 		t.Fatalf("forwardHeartbeats returned error: %v", err)
 	}
@@ -183,16 +177,11 @@ func TestForwardHeartbeatError(t *testing.T) {
 		IsPrimary: true,
 	}
 
-	// Setup debug logging
-	originalDebugLog := debugLog
-	debugLog = log.New(io.Discard, "", 0) // Silence debug logs during test
-	defer func() { debugLog = originalDebugLog }()
-
 	// Test forwarding heartbeat
 	heartbeat := []byte(`{"test":"heartbeat"}`)
 	userAgent := "TestUserAgent"
 
-	_, err := forwardHeartbeat(heartbeat, userAgent, backend)
+	_, err := forwardHeartbeat(context.Background(), heartbeat, userAgent, "", backend)
 	if err == nil {
 		t.Error("Expected error for invalid URL, got none")
 	}
@@ -207,16 +196,11 @@ func TestForwardHeartbeatsError(t *testing.T) {
 		IsPrimary: true,
 	}
 
-	// Setup debug logging
-	originalDebugLog := debugLog
-	debugLog = log.New(io.Discard, "", 0) // Silence debug logs during test
-	defer func() { debugLog = originalDebugLog }()
-
 	// Test forwarding heartbeats
 	heartbeats := []byte(`[{"test":"heartbeat1"},{"test":"heartbeat2"}]`)
 	userAgent := "TestUserAgent"
 
-	_, err := forwardHeartbeats(heartbeats, userAgent, backend)
+	_, err := forwardHeartbeats(context.Background(), heartbeats, userAgent, "", backend)
 	if err == nil {
 		t.Error("Expected error for invalid URL, got none")
 	}
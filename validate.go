@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// configProblem is one thing wrong with a config file.
+type configProblem struct {
+	Line int
+	Msg  string
+}
+
+func (p configProblem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s", p.Line, p.Msg)
+	}
+	return p.Msg
+}
+
+// configErrors lists every problem found in a config file, so they can all be
+// fixed in one go.
+type configErrors []configProblem
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, p := range e {
+		msgs[i] = p.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// keyLines maps dotted key paths, with array tables indexed as in
+// "backends.0.url", to the line they are set on.
+type keyLines map[string]int
+
+// locateKeys finds the line of every table and key in a TOML document. It
+// gives up quietly on syntax errors, which the decoder reports itself.
+func locateKeys(data []byte) keyLines {
+	lines := keyLines{}
+	arrays := map[string]int{}
+
+	var p unstable.Parser
+	p.Reset(data)
+	table := ""
+	for p.NextExpression() {
+		e := p.Expression()
+		keys, line := nodeKeys(&p, e)
+		switch e.Kind {
+		case unstable.Table:
+			table = indexArrays(arrays, keys, false)
+			lines[table] = line
+		case unstable.ArrayTable:
+			arrays[strings.Join(keys, ".")]++
+			table = indexArrays(arrays, keys, true)
+			lines[table] = line
+		case unstable.KeyValue:
+			path := strings.Join(keys, ".")
+			if table != "" {
+				path = table + "." + path
+			}
+			lines[path] = line
+		}
+	}
+	return lines
+}
+
+func nodeKeys(p *unstable.Parser, e *unstable.Node) ([]string, int) {
+	var keys []string
+	line := 0
+	it := e.Key()
+	for it.Next() {
+		n := it.Node()
+		if line == 0 {
+			line = p.Shape(n.Raw).Start.Line
+		}
+		keys = append(keys, string(n.Data))
+	}
+	return keys, line
+}
+
+// indexArrays turns a table header into a path that points at the current
+// element of every array table it passes through.
+func indexArrays(arrays map[string]int, keys []string, last bool) string {
+	var path []string
+	for i, key := range keys {
+		path = append(path, key)
+		if n, ok := arrays[strings.Join(keys[:i+1], ".")]; ok && (last || i < len(keys)-1) {
+			path = append(path, strconv.Itoa(n-1))
+		}
+	}
+	return strings.Join(path, ".")
+}
+
+// of returns the line of the first of the given paths that is in the file.
+func (l keyLines) of(paths ...string) int {
+	for _, path := range paths {
+		if line, ok := l[path]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// backend returns the line of a backend's key, falling back to the line of
+// its [[backends]] header.
+func (l keyLines) backend(i int, key string) int {
+	table := "backends." + strconv.Itoa(i)
+	if key == "" {
+		return l.of(table)
+	}
+	return l.of(table+"."+key, table)
+}
+
+// runValidate implements "multitime validate <config_file>". It prints every
+// problem in the config file and fails if there are any.
+func runValidate(args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: multitime validate <config_file>")
+	}
+
+	_, err := loadConfig(args[0])
+	var problems configErrors
+	switch {
+	case errors.As(err, &problems):
+		for _, p := range problems {
+			fmt.Fprintf(stdout, "%s: %s\n", args[0], p)
+		}
+		return fmt.Errorf("%s is not valid", args[0])
+	case err != nil:
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%s is valid\n", args[0])
+	return nil
+}
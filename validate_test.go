@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocateKeys(t *testing.T) {
+	lines := locateKeys([]byte(`port = 3000
+
+[[backends]]
+name = "A"
+
+[[backends]]
+name = "B"
+retry.jitter = 0.5
+
+[backends.batch]
+size = 10
+`))
+
+	expected := map[string]int{
+		"port":                    1,
+		"backends.0":              3,
+		"backends.0.name":         4,
+		"backends.1.name":         7,
+		"backends.1.retry.jitter": 8,
+		"backends.1.batch":        10,
+		"backends.1.batch.size":   11,
+	}
+	for path, line := range expected {
+		if lines[path] != line {
+			t.Errorf("Expected %s on line %d, got %d", path, line, lines[path])
+		}
+	}
+}
+
+func TestLoadConfigReportsAllProblems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`port = 70000
+log_levle = "debug"
+
+[[backends]]
+name = "WakaTime"
+url = "wakatime.com/api"
+api_key = "key1"
+is_primary = true
+
+[[backends]]
+name = "WakaTime"
+url = "https://example.com/api/"
+api_key = ""
+`), 0o600)
+
+	_, err := loadConfig(path)
+	var problems configErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("Expected configErrors, got %v", err)
+	}
+
+	expected := []configProblem{
+		{2, `unknown key "log_levle"`},
+		{1, "port must be between 1 and 65535"},
+		{6, `backend "WakaTime": url must be an http or https URL, got "wakatime.com/api"`},
+		{11, `backend name "WakaTime" is used more than once`},
+		{13, `backend "WakaTime": api_key is empty`},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for i, p := range expected {
+		if problems[i] != p {
+			t.Errorf("Problem %d: expected %v, got %v", i, p, problems[i])
+		}
+	}
+}
+
+func TestLoadConfigNormalizesURLs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`
+[[backends]]
+name = "WakaTime"
+url = "https://wakatime.com/api/"
+api_key = "key1"
+is_primary = true
+`), 0o600)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if cfg.Backends[0].URL != "https://wakatime.com/api" {
+		t.Errorf("Expected the trailing slash to be removed, got %s", cfg.Backends[0].URL)
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.toml")
+	os.WriteFile(valid, []byte(`
+[[backends]]
+name = "WakaTime"
+url = "https://wakatime.com/api"
+api_key = "key1"
+is_primary = true
+`), 0o600)
+	invalid := filepath.Join(dir, "invalid.toml")
+	os.WriteFile(invalid, []byte(`
+[[backends]]
+name = "WakaTime"
+url = "https://wakatime.com/api"
+api_key = "key1"
+`), 0o600)
+
+	var out bytes.Buffer
+	if err := runValidate([]string{valid}, &out); err != nil {
+		t.Errorf("Expected %s to be valid, got %v", valid, err)
+	}
+	if out.String() != valid+" is valid\n" {
+		t.Errorf("Unexpected output: %s", out.String())
+	}
+
+	out.Reset()
+	if err := runValidate([]string{invalid}, &out); err == nil {
+		t.Error("Expected an error for an invalid config")
+	}
+	if out.String() != invalid+": exactly one backend must be marked as primary\n" {
+		t.Errorf("Unexpected output: %s", out.String())
+	}
+}